@@ -0,0 +1,107 @@
+package zoneregistry
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	refreshDefault = uint32(7200)
+	retryDefault   = uint32(1800)
+	expireDefault  = uint32(86400)
+	minimumDefault = uint32(30)
+)
+
+// SOA holds the configurable fields of the SOA record synthesized at the apex
+// of every zone. Empty Mname and Rname are derived from the zone name.
+type SOA struct {
+	Mname   string
+	Rname   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func newSOA() SOA {
+	return SOA{
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: refreshDefault,
+		Retry:   retryDefault,
+		Expire:  expireDefault,
+		Minimum: minimumDefault,
+	}
+}
+
+// Nameserver is one of the registry's own nameservers, published at the zone apex.
+type Nameserver struct {
+	Host string
+	IPv4 net.IP
+	IPv6 net.IP
+}
+
+// soa returns the SOA record for zone.
+func (zr *ZoneRegistry) soa(zone string) *dns.SOA {
+	mname := zr.SOA.Mname
+	if mname == "" {
+		mname = zr.nameservers(zone)[0].Host
+	}
+	rname := zr.SOA.Rname
+	if rname == "" {
+		rname = "hostmaster." + zone
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: zr.TTL},
+		Ns:      mname,
+		Mbox:    rname,
+		Serial:  zr.SOA.Serial,
+		Refresh: zr.SOA.Refresh,
+		Retry:   zr.SOA.Retry,
+		Expire:  zr.SOA.Expire,
+		Minttl:  zr.SOA.Minimum,
+	}
+}
+
+// negativeSOA returns the SOA record to put in the authority section of a
+// negative answer. Its TTL is capped by the SOA minimum as per RFC 2308.
+func (zr *ZoneRegistry) negativeSOA(zone string) *dns.SOA {
+	soa := zr.soa(zone)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// nameservers returns the registry's nameservers for zone. When none are
+// configured, a single ns1 nameserver inside the zone is assumed.
+func (zr *ZoneRegistry) nameservers(zone string) []*Nameserver {
+	if len(zr.Nameservers) > 0 {
+		return zr.Nameservers
+	}
+	return []*Nameserver{{Host: "ns1." + zone}}
+}
+
+// apexNS returns the NS records for zone and the glue of its nameservers.
+func (zr *ZoneRegistry) apexNS(zone string) (ns []dns.RR, extra []dns.RR) {
+	for _, n := range zr.nameservers(zone) {
+		ns = append(ns, &dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: zr.TTL}, Ns: n.Host})
+		extra = append(extra, zr.addressRecords(n.Host, dns.TypeANY, n.IPv4, n.IPv6)...)
+	}
+	return ns, extra
+}
+
+// serveApex answers a query for the zone apex itself. Only SOA and NS queries
+// have an answer, anything else is left empty for a NODATA response.
+func (zr *ZoneRegistry) serveApex(msg *dns.Msg, qtype uint16, zone string) {
+	switch qtype {
+	case dns.TypeSOA:
+		msg.Answer = []dns.RR{zr.soa(zone)}
+		msg.Ns, msg.Extra = zr.apexNS(zone)
+	case dns.TypeNS:
+		msg.Answer, msg.Extra = zr.apexNS(zone)
+	}
+}
@@ -0,0 +1,172 @@
+package zoneregistry
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	lbRoundRobin = "round_robin"
+	lbRandom     = "random"
+	lbWeighted   = "weighted"
+	lbFirst      = "first"
+	lbLatency    = "latency"
+)
+
+var lbDefault = lbRoundRobin
+
+// Balancer orders the peers a name is delegated to. Implementations must be
+// safe for concurrent use and must not modify the given slice.
+type Balancer interface {
+	Balance(peers []*Peer) []*Peer
+}
+
+// newBalancer returns the Balancer implementing policy, or nil if policy is unknown.
+func newBalancer(policy string) Balancer {
+	switch policy {
+	case lbRoundRobin:
+		return &roundRobin{}
+	case lbRandom:
+		return random{}
+	case lbWeighted:
+		return weighted{}
+	case lbFirst:
+		return first{}
+	case lbLatency:
+		return latency{}
+	}
+	return nil
+}
+
+// roundRobin rotates the peers by one position on every query. Once a peer
+// reported its load, the peers are balanced by weight instead.
+type roundRobin struct {
+	index atomic.Uint64
+}
+
+func (rr *roundRobin) Balance(peers []*Peer) []*Peer {
+	if reportsLoad(peers) {
+		return weighted{}.Balance(peers)
+	}
+	n := len(peers)
+	if n == 0 {
+		return peers
+	}
+	i := int((rr.index.Add(1) - 1) % uint64(n))
+
+	lbPeers := make([]*Peer, n)
+	copy(lbPeers, peers[i:])
+	copy(lbPeers[n-i:], peers[:i])
+	return lbPeers
+}
+
+// random shuffles the peers on every query. Once a peer reported its load,
+// the peers are balanced by weight instead.
+type random struct{}
+
+func (random) Balance(peers []*Peer) []*Peer {
+	if reportsLoad(peers) {
+		return weighted{}.Balance(peers)
+	}
+	lbPeers := append([]*Peer(nil), peers...)
+	rand.Shuffle(len(lbPeers), func(i, j int) { lbPeers[i], lbPeers[j] = lbPeers[j], lbPeers[i] })
+	return lbPeers
+}
+
+// weighted shuffles the peers, a peer's chance of coming first being
+// proportional to its weight, or to the one derived from its reported load.
+// Peers with a null weight come last.
+type weighted struct{}
+
+func (weighted) Balance(peers []*Peer) []*Peer {
+	lbPeers := append([]*Peer(nil), peers...)
+	weights := make([]float64, len(lbPeers))
+	for i, p := range lbPeers {
+		weights[i] = p.weight()
+	}
+
+	for i := range lbPeers {
+		total := 0.0
+		for _, w := range weights[i:] {
+			total += w
+		}
+		if total <= 0 {
+			break
+		}
+
+		r := rand.Float64() * total
+		j := i
+		for ; j < len(lbPeers)-1; j++ {
+			if r < weights[j] {
+				break
+			}
+			r -= weights[j]
+		}
+		// Rounding errors must not pick a peer with a null weight
+		for weights[j] == 0 {
+			j--
+		}
+		lbPeers[i], lbPeers[j] = lbPeers[j], lbPeers[i]
+		weights[i], weights[j] = weights[j], weights[i]
+	}
+	return lbPeers
+}
+
+// reportsLoad reports whether any of the peers reported its load or capacity
+// in its last health check.
+func reportsLoad(peers []*Peer) bool {
+	return slices.ContainsFunc(peers, func(p *Peer) bool { return p.reported.Load() != nil })
+}
+
+// first keeps the peers in their configuration order.
+type first struct{}
+
+func (first) Balance(peers []*Peer) []*Peer { return peers }
+
+// latency orders the peers by their smoothed probe RTT, peers without one
+// coming last. Peers slower than Ceiling, if set, and peers without an RTT are
+// left out unless they all are.
+type latency struct {
+	Ceiling time.Duration
+}
+
+func (l latency) Balance(peers []*Peer) []*Peer {
+	type measured struct {
+		peer *Peer
+		rtt  time.Duration
+	}
+
+	// RTTs are read once, they change while probes complete
+	all := make([]measured, len(peers))
+	var kept []measured
+	for i, p := range peers {
+		all[i] = measured{peer: p, rtt: p.RTT()}
+		if l.Ceiling == 0 || (all[i].rtt > 0 && all[i].rtt <= l.Ceiling) {
+			kept = append(kept, all[i])
+		}
+	}
+	if len(kept) == 0 {
+		kept = all
+	}
+
+	slices.SortStableFunc(kept, func(a, b measured) int {
+		switch {
+		case a.rtt == b.rtt:
+			return 0
+		case a.rtt == 0:
+			return 1
+		case b.rtt == 0:
+			return -1
+		}
+		return cmp.Compare(a.rtt, b.rtt)
+	})
+
+	lbPeers := make([]*Peer, len(kept))
+	for i, m := range kept {
+		lbPeers[i] = m.peer
+	}
+	return lbPeers
+}
@@ -0,0 +1,168 @@
+package zoneregistry
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestBalancers(t *testing.T) {
+	newPeer := func(host string, weight uint32) *Peer {
+		p := NewPeer()
+		p.Host, p.Weight = host, weight
+		return p
+	}
+	peers := []*Peer{newPeer("p1.", 1), newPeer("p2.", 0), newPeer("p3.", 5)}
+
+	tests := []struct {
+		policy        string
+		expectedFirst []string // expected first peer on consecutive calls, empty if random
+		expectedLast  string   // expected last peer, empty if random
+	}{
+		{policy: lbRoundRobin, expectedFirst: []string{"p1.", "p2.", "p3.", "p1."}},
+		{policy: lbFirst, expectedFirst: []string{"p1.", "p1."}, expectedLast: "p3."},
+		{policy: lbWeighted, expectedLast: "p2."},
+		{policy: lbRandom},
+	}
+
+	for i, test := range tests {
+		b := newBalancer(test.policy)
+		for j := 0; j < 10; j++ {
+			lbPeers := b.Balance(peers)
+			if len(lbPeers) != len(peers) {
+				t.Fatalf("Test %d, expected %d peers, got: %d", i, len(peers), len(lbPeers))
+			}
+			if j < len(test.expectedFirst) && lbPeers[0].Host != test.expectedFirst[j] {
+				t.Errorf("Test %d, call %d, expected first peer %s, got: %s", i, j, test.expectedFirst[j], lbPeers[0].Host)
+			}
+			if test.expectedLast != "" && lbPeers[len(lbPeers)-1].Host != test.expectedLast {
+				t.Errorf("Test %d, call %d, expected last peer %s, got: %s", i, j, test.expectedLast, lbPeers[len(lbPeers)-1].Host)
+			}
+		}
+		// Balancing must not reorder the input
+		if peers[0].Host != "p1." || peers[1].Host != "p2." || peers[2].Host != "p3." {
+			t.Errorf("Test %d, input peers were modified", i)
+		}
+	}
+
+	if newBalancer("asdf") != nil {
+		t.Errorf("Expected no balancer for an unknown policy")
+	}
+}
+
+func TestWeightedReported(t *testing.T) {
+	p1, p2 := NewPeer(), NewPeer()
+	p1.Host, p2.Host = "p1.", "p2."
+	// p1 reports no capacity left, p2 keeps its configured weight
+	capacity := 0.0
+	p1.reported.Store(&capacity)
+
+	b := newBalancer(lbWeighted)
+	for j := 0; j < 10; j++ {
+		if lbPeers := b.Balance([]*Peer{p1, p2}); lbPeers[0].Host != "p2." {
+			t.Errorf("Call %d, expected first peer p2., got: %s", j, lbPeers[0].Host)
+		}
+	}
+}
+
+func TestServeDNSReportedLoad(t *testing.T) {
+	zr := newTestZoneRegistry()
+	p1, p2 := NewPeer(), NewPeer()
+	p1.Host, p1.IPv4, p1.Healthy, p1.Checked = "p1.example.org.", net.ParseIP("10.0.0.1"), true, true
+	p2.Host, p2.IPv4, p2.Healthy, p2.Checked = "p2.example.org.", net.ParseIP("10.0.0.2"), true, true
+	loaded, idle := 1.0, 100.0
+	p1.reported.Store(&loaded)
+	p2.reported.Store(&idle)
+	zr.Peers = []*Peer{p1, p2}
+	zr.publishHealth()
+
+	// The default round_robin balancer follows the reported load
+	first := map[string]int{}
+	for range 100 {
+		m := new(dns.Msg)
+		m.SetQuestion("app.example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		zr.ServeDNS(context.TODO(), rec, m)
+		first[rec.Msg.Ns[0].(*dns.NS).Ns]++
+	}
+	if first["p2.example.org."] < 90 {
+		t.Errorf("Expected the least loaded peer first in most answers, got %v", first)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	newPeer := func(host string, rtt time.Duration) *Peer {
+		p := NewPeer()
+		p.Host = host
+		p.rtt.Store(int64(rtt))
+		return p
+	}
+	far := newPeer("far.", 80*time.Millisecond)
+	unknown := newPeer("unknown.", 0)
+	near := newPeer("near.", 5*time.Millisecond)
+	mid := newPeer("mid.", 20*time.Millisecond)
+
+	tests := []struct {
+		peers         []*Peer
+		ceiling       time.Duration
+		expectedHosts []string
+	}{
+		{
+			peers:         []*Peer{far, unknown, near, mid},
+			expectedHosts: []string{"near.", "mid.", "far.", "unknown."},
+		},
+		{
+			peers:         []*Peer{far, unknown, near, mid},
+			ceiling:       50 * time.Millisecond,
+			expectedHosts: []string{"near.", "mid."},
+		},
+		// All peers are kept when they all exceed the ceiling
+		{
+			peers:         []*Peer{far, unknown, near, mid},
+			ceiling:       time.Millisecond,
+			expectedHosts: []string{"near.", "mid.", "far.", "unknown."},
+		},
+		{
+			peers:         []*Peer{unknown},
+			ceiling:       time.Millisecond,
+			expectedHosts: []string{"unknown."},
+		},
+	}
+
+	for i, test := range tests {
+		lbPeers := latency{Ceiling: test.ceiling}.Balance(test.peers)
+		if len(lbPeers) != len(test.expectedHosts) {
+			t.Fatalf("Test %d, expected %d peers, got: %d", i, len(test.expectedHosts), len(lbPeers))
+		}
+		for j, host := range test.expectedHosts {
+			if lbPeers[j].Host != host {
+				t.Errorf("Test %d, expected peer %s at %d, got: %s", i, host, j, lbPeers[j].Host)
+			}
+		}
+	}
+}
+
+func TestRoundRobinConcurrent(t *testing.T) {
+	peers := []*Peer{NewPeer(), NewPeer(), NewPeer()}
+	b := newBalancer(lbRoundRobin)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if lbPeers := b.Balance(peers); len(lbPeers) != len(peers) {
+					t.Errorf("Expected %d peers, got: %d", len(peers), len(lbPeers))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,255 @@
+package zoneregistry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	checkHTTP = "http"
+	checkTCP  = "tcp"
+	checkDNS  = "dns"
+	checkGRPC = "grpc"
+	checkExec = "exec"
+)
+
+// maxOutputSize is the maximum size of the output of an exec check kept for the logs.
+const maxOutputSize = 4 << 10
+
+// HealthChecker probes a peer on one of its addresses. Check returns nil when
+// the peer is healthy on ip. Implementations must honor the deadline of ctx.
+type HealthChecker interface {
+	Check(ctx context.Context, p *Peer, ip net.IP) error
+}
+
+// idleCloser is implemented by the health checks keeping connections open to
+// the peer between probes.
+type idleCloser interface {
+	CloseIdleConnections()
+}
+
+// newHealthChecker returns an empty HealthChecker of type kind, or nil if kind is unknown.
+func newHealthChecker(kind string) HealthChecker {
+	switch kind {
+	case checkHTTP:
+		return &httpCheck{}
+	case checkTCP:
+		return &tcpCheck{}
+	case checkDNS:
+		return &dnsCheck{}
+	case checkGRPC:
+		return &grpcCheck{}
+	case checkExec:
+		return &execCheck{}
+	}
+	return nil
+}
+
+// tcpCheck expects a TCP connection to be accepted. A zero Port defaults to the
+// peer's Port.
+type tcpCheck struct {
+	Port uint32
+}
+
+func (t *tcpCheck) Check(ctx context.Context, p *Peer, ip net.IP) error {
+	port := t.Port
+	if port == 0 {
+		port = p.Port
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// dnsCheck expects an authoritative answer to a SOA query for the peer's
+// delegated subzone. A zero Port defaults to the peer's DNSPort.
+type dnsCheck struct {
+	Port      uint32
+	Transport string
+}
+
+func (d *dnsCheck) Check(ctx context.Context, p *Peer, ip net.IP) error {
+	port := d.Port
+	if port == 0 {
+		port = p.DNSPort
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(p.Host, dns.TypeSOA)
+	client := &dns.Client{Net: d.Transport}
+	resp, _, err := client.ExchangeContext(ctx, m, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	if err != nil {
+		return err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("unexpected rcode %s", dns.RcodeToString[resp.Rcode])
+	}
+	if !resp.Authoritative {
+		return errors.New("answer is not authoritative")
+	}
+	for _, rr := range resp.Answer {
+		if _, ok := rr.(*dns.SOA); ok {
+			return nil
+		}
+	}
+	return errors.New("no SOA record in answer")
+}
+
+// grpcCheck expects a SERVING status from the gRPC health checking protocol. A
+// zero Port defaults to the peer's Port, an empty Service checks the whole server.
+type grpcCheck struct {
+	Port    uint32
+	Service string
+}
+
+func (g *grpcCheck) Check(ctx context.Context, p *Peer, ip net.IP) error {
+	port := g.Port
+	if port == 0 {
+		port = p.Port
+	}
+
+	conn, err := grpc.NewClient(net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: g.Service})
+	if err != nil {
+		return err
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("unexpected status %s", resp.GetStatus())
+	}
+	return nil
+}
+
+// execCheck runs a local command, the peer being healthy when it exits with a
+// zero status. The command runs once per attempt for the whole peer, whose
+// addresses all share its result. The peer is described to the command by
+// environment variables, and the command is killed at the deadline of the
+// attempt.
+type execCheck struct {
+	Command string
+	Args    []string
+}
+
+func (e *execCheck) Check(ctx context.Context, p *Peer, ip net.IP) error {
+	return oncePerProbe(ctx, e, func() error { return e.run(ctx, p) })
+}
+
+// run runs the command for p.
+func (e *execCheck) run(ctx context.Context, p *Peer) error {
+	cmd := exec.CommandContext(ctx, e.Command, e.Args...)
+	cmd.Env = append(os.Environ(), e.env(p)...)
+	// Don't wait for the children holding the output open once killed
+	cmd.WaitDelay = time.Second
+
+	var out bytes.Buffer
+	cmd.Stdout = &limitedWriter{w: &out, n: maxOutputSize}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// env returns the environment variables describing the peer and its addresses.
+func (e *execCheck) env(p *Peer) []string {
+	env := []string{
+		"ZONEREGISTRY_PEER=" + strings.TrimSuffix(p.Host, "."),
+		"ZONEREGISTRY_ROLE=" + p.Role,
+		"ZONEREGISTRY_LABELS=" + strings.Join(p.Labels, " "),
+	}
+	for _, family := range allFamilies {
+		var addrs []string
+		for _, ip := range p.addrs(family) {
+			addrs = append(addrs, ip.String())
+		}
+		if len(addrs) > 0 {
+			env = append(env, "ZONEREGISTRY_"+strings.ToUpper(family)+"="+strings.Join(addrs, " "))
+		}
+	}
+	return env
+}
+
+// probeRuns holds the result of the checks run once per attempt of a probe,
+// shared by the addresses of the peer.
+type probeRuns struct {
+	mu   sync.Mutex
+	runs map[HealthChecker]*probeRun
+}
+
+type probeRun struct {
+	once sync.Once
+	err  error
+}
+
+type probeRunsKey struct{}
+
+// withProbeRuns returns a copy of ctx in which the checks calling oncePerProbe
+// run once.
+func withProbeRuns(ctx context.Context) context.Context {
+	return context.WithValue(ctx, probeRunsKey{}, &probeRuns{runs: map[HealthChecker]*probeRun{}})
+}
+
+// oncePerProbe runs fn for check once per context returned by withProbeRuns,
+// and returns its error to every caller. fn is run on every call outside of
+// such a context.
+func oncePerProbe(ctx context.Context, check HealthChecker, fn func() error) error {
+	pr, ok := ctx.Value(probeRunsKey{}).(*probeRuns)
+	if !ok {
+		return fn()
+	}
+
+	pr.mu.Lock()
+	run := pr.runs[check]
+	if run == nil {
+		run = &probeRun{}
+		pr.runs[check] = run
+	}
+	pr.mu.Unlock()
+
+	run.once.Do(func() { run.err = fn() })
+	return run.err
+}
+
+// limitedWriter writes up to n bytes to w and silently discards the rest.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if l.n > 0 {
+		k := min(len(b), l.n)
+		l.n -= k
+		if _, err := l.w.Write(b[:k]); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,193 @@
+package zoneregistry
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// listenerPort returns the port part of addr.
+func listenerPort(t *testing.T, addr string) uint32 {
+	t.Helper()
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return uint32(p)
+}
+
+func TestTCPCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listenerPort(t, l.Addr().String())
+
+	peer := NewPeer()
+	ip := net.ParseIP("127.0.0.1")
+	if err := (&tcpCheck{Port: port}).Check(context.TODO(), peer, ip); err != nil {
+		t.Errorf("Expected no error on an open port, got %v", err)
+	}
+
+	l.Close()
+	if err := (&tcpCheck{Port: port}).Check(context.TODO(), peer, ip); err == nil {
+		t.Errorf("Expected error on a closed port")
+	}
+}
+
+func TestDNSCheck(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Name == "peer1.example.org." {
+			ret.Authoritative = true
+			ret.Answer = append(ret.Answer, test.SOA("peer1.example.org. 30 IN SOA ns.peer1.example.org. hostmaster.peer1.example.org. 1 7200 1800 86400 30"))
+		} else {
+			ret.Rcode = dns.RcodeRefused
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tests := []struct {
+		host      string
+		shouldErr bool
+	}{
+		{host: "peer1.example.org.", shouldErr: false},
+		{host: "peer2.example.org.", shouldErr: true},
+	}
+
+	for i, tc := range tests {
+		peer := NewPeer()
+		peer.Host = tc.host
+		peer.DNSPort = listenerPort(t, s.Addr)
+		err := (&dnsCheck{}).Check(context.TODO(), peer, net.ParseIP("127.0.0.1"))
+
+		if tc.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error for %s", i, tc.host)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error for %s, got %v", i, tc.host, err)
+		}
+	}
+}
+
+func TestGRPCCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	hs.SetServingStatus("ready", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("draining", healthpb.HealthCheckResponse_NOT_SERVING)
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	go s.Serve(l)
+	defer s.Stop()
+
+	tests := []struct {
+		service   string
+		shouldErr bool
+	}{
+		{service: "", shouldErr: false},
+		{service: "ready", shouldErr: false},
+		{service: "draining", shouldErr: true},
+	}
+
+	for i, tc := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := (&grpcCheck{Port: listenerPort(t, l.Addr().String()), Service: tc.service}).Check(ctx, NewPeer(), net.ParseIP("127.0.0.1"))
+		cancel()
+
+		if tc.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error for service %q", i, tc.service)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error for service %q, got %v", i, tc.service, err)
+		}
+	}
+}
+
+func TestExecCheck(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	peer := NewPeer()
+	peer.Host = "peer.example.org."
+	peer.Labels = []string{"env=prod", "region=eu"}
+	peer.IPv4 = net.ParseIP("127.0.0.1")
+	ip := peer.IPv4
+
+	tests := []struct {
+		script    string
+		timeout   time.Duration
+		shouldErr bool
+	}{
+		{script: `exit 0`, shouldErr: false},
+		{script: `exit 1`, shouldErr: true},
+		{script: `[ "$ZONEREGISTRY_PEER" = peer.example.org ] && [ "$ZONEREGISTRY_IPV4" = 127.0.0.1 ] && [ "$ZONEREGISTRY_LABELS" = "env=prod region=eu" ]`, shouldErr: false},
+		{script: `sleep 5`, timeout: 100 * time.Millisecond, shouldErr: true},
+	}
+
+	for i, test := range tests {
+		ctx := context.Background()
+		if test.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.timeout)
+			defer cancel()
+		}
+
+		start := time.Now()
+		err := (&execCheck{Command: "sh", Args: []string{"-c", test.script}}).Check(ctx, peer, ip)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+		}
+		if test.timeout > 0 && time.Since(start) > 2*time.Second {
+			t.Errorf("Test %d: Expected the command to be killed at the deadline", i)
+		}
+	}
+}
+
+func TestExecCheckOncePerPeer(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	peer := NewPeer()
+	peer.Host = "peer.example.org."
+	peer.IPv4 = net.ParseIP("127.0.0.1")
+	peer.IPv6 = net.ParseIP("::1")
+
+	runs := filepath.Join(t.TempDir(), "runs")
+	peer.Check = &execCheck{Command: "sh", Args: []string{"-c", `[ "$ZONEREGISTRY_IPV6" = ::1 ] && echo run >> ` + runs}}
+
+	addrs, _ := peer.probe(context.Background(), peer.Check, time.Second)
+	if !addrs["127.0.0.1"] || !addrs["::1"] {
+		t.Errorf("Expected both addresses to pass, got %v", addrs)
+	}
+	out, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(out), "run"); n != 1 {
+		t.Errorf("Expected the command to run once, ran %d times", n)
+	}
+}
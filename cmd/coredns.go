@@ -10,11 +10,12 @@ import (
 	_ "github.com/coredns/coredns/plugin/reload"
 	_ "github.com/coredns/coredns/plugin/whoami"
 
-	_ "github.com/gcleroux/zoneregistry"
+	"github.com/gcleroux/zoneregistry"
 )
 
 func init() {
 	dnsserver.Directives = append(dnsserver.Directives, "zoneregistry")
+	zoneregistry.AcceptUpdateMessages()
 }
 
 func main() {
@@ -0,0 +1,103 @@
+package zoneregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	policyAll    = "all"
+	policyAny    = "any"
+	policyQuorum = "quorum"
+)
+
+// namedCheck is one of the health checks of a compositeCheck.
+type namedCheck struct {
+	Name  string
+	Check HealthChecker
+}
+
+// compositeCheck runs several health checks concurrently and combines their
+// results. The peer is healthy when all of them, any of them, or at least
+// Quorum of them succeed, depending on Policy.
+type compositeCheck struct {
+	Checks []namedCheck
+	Policy string
+	Quorum int
+}
+
+func (cc *compositeCheck) Check(ctx context.Context, p *Peer, ip net.IP) error {
+	errs := make([]error, len(cc.Checks))
+	var wg sync.WaitGroup
+	for i, nc := range cc.Checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = nc.Check.Check(ctx, p, ip)
+		}()
+	}
+	wg.Wait()
+
+	family := ipFamily(ip)
+	passed := 0
+	var failed []error
+	for i, nc := range cc.Checks {
+		if errs[i] != nil {
+			log.Debugf("Health check %s of %s failed (%s): %v", nc.Name, p.Host, ip, errs[i])
+			checkHealthy.WithLabelValues(p.Host, nc.Name, family).Set(0)
+			failed = append(failed, fmt.Errorf("%s: %w", nc.Name, errs[i]))
+			continue
+		}
+		log.Debugf("Health check %s of %s succeeded (%s)", nc.Name, p.Host, ip)
+		checkHealthy.WithLabelValues(p.Host, nc.Name, family).Set(1)
+		passed++
+	}
+
+	if required := cc.required(); passed < required {
+		return fmt.Errorf("%d of %d checks passed, %d required: %w", passed, len(cc.Checks), required, errors.Join(failed...))
+	}
+	return nil
+}
+
+// required returns the number of checks that must succeed.
+func (cc *compositeCheck) required() int {
+	switch cc.Policy {
+	case policyAny:
+		return 1
+	case policyQuorum:
+		return cc.Quorum
+	}
+	return len(cc.Checks)
+}
+
+// peerCheck returns the health check of a peer declaring the checks of cc: nil
+// for the default one, the check itself when there is only one.
+func (cc *compositeCheck) peerCheck() HealthChecker {
+	switch len(cc.Checks) {
+	case 0:
+		return nil
+	case 1:
+		return cc.Checks[0].Check
+	}
+	return cc
+}
+
+// CloseIdleConnections closes the connections kept open by the checks.
+func (cc *compositeCheck) CloseIdleConnections() {
+	for _, nc := range cc.Checks {
+		if c, ok := nc.Check.(idleCloser); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+// ipFamily returns the address family of ip.
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return familyIPv4
+	}
+	return familyIPv6
+}
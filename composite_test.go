@@ -0,0 +1,54 @@
+package zoneregistry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// staticCheck always returns err.
+type staticCheck struct {
+	err error
+}
+
+func (s staticCheck) Check(ctx context.Context, p *Peer, ip net.IP) error { return s.err }
+
+func TestCompositeCheck(t *testing.T) {
+	pass, fail := staticCheck{}, staticCheck{err: errors.New("down")}
+	checks := []namedCheck{{Name: "ingress", Check: pass}, {Name: "dns", Check: fail}, {Name: "api", Check: pass}}
+
+	tests := []struct {
+		policy    string
+		quorum    int
+		checks    []namedCheck
+		shouldErr bool
+	}{
+		{policy: policyAll, checks: checks, shouldErr: true},
+		{policy: policyAll, checks: []namedCheck{checks[0], checks[2]}, shouldErr: false},
+		{policy: policyAny, checks: checks, shouldErr: false},
+		{policy: policyAny, checks: []namedCheck{checks[1]}, shouldErr: true},
+		{policy: policyQuorum, quorum: 2, checks: checks, shouldErr: false},
+		{policy: policyQuorum, quorum: 3, checks: checks, shouldErr: true},
+	}
+
+	peer := NewPeer()
+	peer.Host = "peer.example.org."
+	for i, test := range tests {
+		cc := &compositeCheck{Checks: test.checks, Policy: test.policy, Quorum: test.quorum}
+		err := cc.Check(context.TODO(), peer, net.ParseIP("127.0.0.1"))
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+		}
+	}
+
+	if v := gaugeValue(checkHealthy.WithLabelValues(peer.Host, "ingress", familyIPv4)); v != 1 {
+		t.Errorf("Expected the ingress check to be reported healthy, got %v", v)
+	}
+	if v := gaugeValue(checkHealthy.WithLabelValues(peer.Host, "dns", familyIPv4)); v != 0 {
+		t.Errorf("Expected the dns check to be reported unhealthy, got %v", v)
+	}
+}
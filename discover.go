@@ -0,0 +1,182 @@
+package zoneregistry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	discoverSRV = "srv"
+
+	// discoverRefreshDefault is how often the SRV records are resolved.
+	discoverRefreshDefault = 30 * time.Second
+)
+
+// srvDiscovery builds peers from the SRV records of Name, resolved every
+// Refresh against Resolver. Each target becomes a peer checked on the SRV
+// port, primary if it has the lowest priority of the set, secondary otherwise.
+// The peers whose record didn't change from one resolution to the next are
+// kept as is, with their health.
+type srvDiscovery struct {
+	Name     string
+	Resolver string
+	Refresh  time.Duration
+
+	entries map[string]srvEntry
+	peers   map[string]*Peer
+}
+
+// srvEntry is what a discovered peer is made of.
+type srvEntry struct {
+	Role   string
+	Port   uint16
+	Weight uint16
+	IPv4   string
+	IPv6   string
+}
+
+// source returns the name of the discovery as a source of peers.
+func (d *srvDiscovery) source() string { return discoverSRV + ":" + d.Name }
+
+// resolve returns the peers currently published in the SRV records. A name
+// that doesn't exist has no peers, other failures are returned as errors.
+func (d *srvDiscovery) resolve(ctx context.Context) ([]*Peer, error) {
+	resp, err := exchange(ctx, d.Resolver, d.Name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return d.update(nil, nil), nil
+	default:
+		return nil, fmt.Errorf("unexpected rcode %s for %s", dns.RcodeToString[resp.Rcode], d.Name)
+	}
+
+	var srvs []*dns.SRV
+	for _, rr := range resp.Answer {
+		if srv, ok := rr.(*dns.SRV); ok && srv.Target != "." {
+			srvs = append(srvs, srv)
+		}
+	}
+	if len(srvs) == 0 {
+		return d.update(nil, nil), nil
+	}
+	lowest := srvs[0].Priority
+	for _, srv := range srvs {
+		lowest = min(lowest, srv.Priority)
+	}
+
+	// Addresses are taken from the additional section when the resolver sent them
+	glue := map[string][]dns.RR{}
+	for _, rr := range resp.Extra {
+		name := strings.ToLower(rr.Header().Name)
+		glue[name] = append(glue[name], rr)
+	}
+
+	entries := map[string]srvEntry{}
+	var order []string
+	for _, srv := range srvs {
+		host := strings.ToLower(dns.Fqdn(srv.Target))
+		if _, ok := entries[host]; ok {
+			continue
+		}
+
+		rrs := glue[host]
+		if len(rrs) == 0 {
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				resp, err := exchange(ctx, d.Resolver, host, qtype)
+				if err != nil {
+					return nil, err
+				}
+				rrs = append(rrs, resp.Answer...)
+			}
+		}
+
+		e := srvEntry{Role: "secondary", Port: srv.Port, Weight: srv.Weight}
+		if srv.Priority == lowest {
+			e.Role = "primary"
+		}
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.A:
+				if e.IPv4 == "" {
+					e.IPv4 = rr.A.String()
+				}
+			case *dns.AAAA:
+				if e.IPv6 == "" {
+					e.IPv6 = rr.AAAA.String()
+				}
+			}
+		}
+		if e.IPv4 == "" && e.IPv6 == "" {
+			log.Warningf("Ignoring %s from %s, it has no address", host, d.Name)
+			continue
+		}
+		entries[host] = e
+		order = append(order, host)
+	}
+	return d.update(entries, order), nil
+}
+
+// update makes entries the current state of the discovery and returns their
+// peers in order, reusing the peers whose entry didn't change.
+func (d *srvDiscovery) update(entries map[string]srvEntry, order []string) []*Peer {
+	peers := make(map[string]*Peer, len(entries))
+	list := make([]*Peer, 0, len(order))
+	for _, host := range order {
+		e := entries[host]
+		peer, ok := d.peers[host]
+		if !ok || d.entries[host] != e {
+			peer = e.peer(host)
+		}
+		peers[host] = peer
+		list = append(list, peer)
+	}
+	d.entries, d.peers = entries, peers
+	return list
+}
+
+// peer returns a new peer for the entry of host.
+func (e srvEntry) peer(host string) *Peer {
+	peer := NewPeer()
+	peer.Host = host
+	peer.Role = e.Role
+	peer.Port = uint32(e.Port)
+	peer.Weight = uint32(e.Weight)
+	peer.IPv4 = net.ParseIP(e.IPv4)
+	peer.IPv6 = net.ParseIP(e.IPv6)
+	return peer
+}
+
+// discover resolves d and replaces its peers. On failure the previous peers
+// are kept.
+func (zr *ZoneRegistry) discover(ctx context.Context, d *srvDiscovery) {
+	peers, err := d.resolve(ctx)
+	if err != nil {
+		log.Errorf("Failed to discover peers from %s, keeping the previous ones: %v", d.Name, err)
+		return
+	}
+	zr.setPeers(d.source(), peers)
+	log.Debugf("Discovered %d peers from %s", len(peers), d.Name)
+}
+
+// watchDiscovery resolves d every Refresh until ctx is cancelled.
+func (zr *ZoneRegistry) watchDiscovery(ctx context.Context, d *srvDiscovery) {
+	ticker := time.NewTicker(d.Refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		zr.discover(ctx, d)
+	}
+}
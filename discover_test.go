@@ -0,0 +1,139 @@
+package zoneregistry
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestSRVDiscovery(t *testing.T) {
+	// The second version of the set drops peer2 and moves peer3 to port 9090
+	var version atomic.Int32
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		q := r.Question[0]
+		switch {
+		case q.Name == "_zoneregistry._tcp.example.org." && q.Qtype == dns.TypeSRV:
+			ret.Answer = []dns.RR{
+				test.SRV("_zoneregistry._tcp.example.org. 30 IN SRV 10 5 8080 peer1.example.org."),
+				test.SRV("_zoneregistry._tcp.example.org. 30 IN SRV 20 5 8443 peer3.example.org."),
+			}
+			ret.Extra = []dns.RR{test.A("peer1.example.org. 30 IN A 10.0.0.1")}
+			if version.Load() == 0 {
+				ret.Answer = append(ret.Answer, test.SRV("_zoneregistry._tcp.example.org. 30 IN SRV 10 1 8080 peer2.example.org."))
+				ret.Extra = append(ret.Extra, test.AAAA("peer2.example.org. 30 IN AAAA 2001:db8::2"))
+			} else {
+				ret.Answer[1] = test.SRV("_zoneregistry._tcp.example.org. 30 IN SRV 20 5 9090 peer3.example.org.")
+			}
+		case q.Name == "peer3.example.org." && q.Qtype == dns.TypeA:
+			ret.Answer = []dns.RR{test.A("peer3.example.org. 30 IN A 10.0.0.3")}
+		case q.Name == "_missing._tcp.example.org.":
+			ret.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	d := &srvDiscovery{Name: "_zoneregistry._tcp.example.org.", Resolver: s.Addr}
+	peers, err := d.resolve(context.TODO())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []struct {
+		host   string
+		role   string
+		port   uint32
+		weight uint32
+		ip     string
+	}{
+		{host: "peer1.example.org.", role: "primary", port: 8080, weight: 5, ip: "10.0.0.1"},
+		{host: "peer3.example.org.", role: "secondary", port: 8443, weight: 5, ip: "10.0.0.3"},
+		{host: "peer2.example.org.", role: "primary", port: 8080, weight: 1, ip: "2001:db8::2"},
+	}
+	if len(peers) != len(expected) {
+		t.Fatalf("Expected %d peers, got %d", len(expected), len(peers))
+	}
+	for i, e := range expected {
+		p := peers[i]
+		ip := p.IPv4
+		if ip == nil {
+			ip = p.IPv6
+		}
+		if p.Host != e.host || p.Role != e.role || p.Port != e.port || p.Weight != e.weight || ip.String() != e.ip {
+			t.Errorf("Peer %d, expected %v, got %s %s %d %d %s", i, e, p.Host, p.Role, p.Port, p.Weight, ip)
+		}
+	}
+
+	version.Store(1)
+	next, err := d.resolve(context.TODO())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(next) != 2 {
+		t.Fatalf("Expected the removed peer to be dropped, got %d peers", len(next))
+	}
+	if next[0] != peers[0] {
+		t.Errorf("Expected the unchanged peer to be kept")
+	}
+	if next[1] == peers[1] || next[1].Port != 9090 {
+		t.Errorf("Expected the modified peer to be replaced")
+	}
+
+	missing := &srvDiscovery{Name: "_missing._tcp.example.org.", Resolver: s.Addr}
+	if peers, err := missing.resolve(context.TODO()); err != nil || len(peers) != 0 {
+		t.Errorf("Expected no peers and no error for a missing name, got %d peers and %v", len(peers), err)
+	}
+}
+
+func TestDiscoveryOnStartup(t *testing.T) {
+	// The resolver is slow to answer, the startup must not wait for it
+	port := newPeerServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(300 * time.Millisecond)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = []dns.RR{test.SRV("_zoneregistry._tcp.example.org. 30 IN SRV 10 1 1 peer1.example.org.")}
+		ret.Extra = []dns.RR{test.A("peer1.example.org. 30 IN A 127.0.0.1")}
+		w.WriteMsg(ret)
+	})
+
+	zr := newZoneRegistry()
+	zr.Timeout = 1
+	zr.Upstream = "127.0.0.1:53"
+	zr.Discoveries = []*srvDiscovery{{
+		Name:     "_zoneregistry._tcp.example.org.",
+		Resolver: net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))),
+		Refresh:  time.Hour,
+	}}
+
+	start := time.Now()
+	if err := zr.OnStartup(); err != nil {
+		t.Fatalf("Expected no error on startup, got %v", err)
+	}
+	defer zr.OnShutdown()
+	if time.Since(start) > 200*time.Millisecond {
+		t.Errorf("Expected the startup not to wait for the discovery, took %s", time.Since(start))
+	}
+	if zr.Ready() {
+		t.Errorf("Expected the registry not to be ready before the first discovery")
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for !zr.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the registry to be ready after the first discovery")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if snap := zr.health.Load(); len(snap.peers) != 1 || snap.peers[0].Host != "peer1.example.org." {
+		t.Errorf("Expected the discovered peer to be checked before being ready, got %v", snap.peers)
+	}
+}
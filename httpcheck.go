@@ -0,0 +1,370 @@
+package zoneregistry
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBodySize is the maximum size of a health check response body read for assertions.
+const maxBodySize = 1 << 20
+
+// idleConnTimeout is how long a connection to a peer is kept open between probes.
+const idleConnTimeout = 90 * time.Second
+
+// httpCheck sends an HTTP request to the peer and asserts the response. Its
+// empty Protocol, Path and Port default to the peer's, and an empty Status
+// only accepts a 200 status code.
+type httpCheck struct {
+	Protocol string
+	Path     string
+	Port     uint32
+
+	// Request
+	Method  string
+	Host    string
+	Headers http.Header
+	Body    string
+
+	// Response assertions
+	Status        []statusRange
+	ExpectBody    *regexp.Regexp
+	ExpectJSON    []jsonAssertion
+	ExpectHeaders []headerAssertion
+
+	// Report reads the load or capacity reported by the peer, if set.
+	Report *loadReport
+
+	// transport is created on the first probe and kept, so that connections
+	// to the peer are reused from one probe to the next. mu guards it.
+	mu        sync.Mutex
+	transport *http.Transport
+}
+
+// statusRange is an inclusive range of accepted status codes.
+type statusRange struct {
+	Low, High int
+}
+
+// jsonAssertion expects the value at Path in the JSON response body to be Value.
+// Path is a dot separated list of object keys and array indexes.
+type jsonAssertion struct {
+	Path  string
+	Value string
+}
+
+const (
+	// reportCapacity is a free capacity, used as the peer's weight.
+	reportCapacity = "capacity"
+	// reportLoad is a utilization between 0 and 1, reducing the peer's weight.
+	reportLoad = "load"
+)
+
+// loadReport reads a load or capacity reported by the peer in its health check
+// response, at Path in the JSON body or in the Header response header.
+type loadReport struct {
+	Kind   string
+	Path   string
+	Header string
+}
+
+// headerAssertion expects the Name response header to be present, and to match
+// Value if set.
+type headerAssertion struct {
+	Name  string
+	Value *regexp.Regexp
+}
+
+func (h *httpCheck) Check(ctx context.Context, p *Peer, ip net.IP) error {
+	protocol, path, port := h.Protocol, h.Path, h.Port
+	if protocol == "" {
+		protocol = p.Protocol
+	}
+	if path == "" {
+		path = p.Path
+	}
+	if port == 0 {
+		port = p.Port
+	}
+	url := fmt.Sprintf("%s://%s%s", protocol, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), path)
+
+	method := h.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if h.Body != "" {
+		body = strings.NewReader(h.Body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	for name, values := range h.Headers {
+		req.Header[name] = values
+	}
+	if h.Host != "" {
+		req.Host = h.Host
+	}
+
+	resp, err := h.client(p).Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Drain the body so that the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodySize))
+		resp.Body.Close()
+	}()
+
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		expiry := time.Until(resp.TLS.PeerCertificates[0].NotAfter)
+		certificateExpiry.WithLabelValues(p.Host).Set(expiry.Hours() / 24)
+	}
+
+	log.Debugf("%s - %d", url, resp.StatusCode)
+
+	var data []byte
+	if h.readsBody() {
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, maxBodySize)); err != nil {
+			return err
+		}
+	}
+	if err := h.assert(resp, data); err != nil {
+		return err
+	}
+	if h.Report != nil {
+		h.Report.update(p, resp, data)
+	}
+	return nil
+}
+
+// readsBody reports whether the response body is needed by the check.
+func (h *httpCheck) readsBody() bool {
+	return h.ExpectBody != nil || len(h.ExpectJSON) > 0 || (h.Report != nil && h.Report.Header == "")
+}
+
+// client returns the HTTP client of the check, with a keep-alive transport
+// dedicated to the peer.
+func (h *httpCheck) client(p *Peer) *http.Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.transport == nil {
+		h.transport = &http.Transport{
+			TLSClientConfig:     h.tlsConfig(p),
+			MaxIdleConnsPerHost: 1,
+			IdleConnTimeout:     idleConnTimeout,
+		}
+	}
+	return &http.Client{Transport: h.transport}
+}
+
+// CloseIdleConnections closes the connections kept open to the peer.
+func (h *httpCheck) CloseIdleConnections() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.transport != nil {
+		h.transport.CloseIdleConnections()
+	}
+}
+
+// tlsConfig returns the TLS configuration of the peer. The server name defaults
+// to the Host override of the check, then to the peer's host, since the
+// request is sent to an IP address.
+func (h *httpCheck) tlsConfig(p *Peer) *tls.Config {
+	cfg := &tls.Config{}
+	if p.TLS != nil {
+		cfg = p.TLS.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = h.Host
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = strings.TrimSuffix(p.Host, ".")
+	}
+	return cfg
+}
+
+// assert checks resp and its body against the response assertions of the check.
+func (h *httpCheck) assert(resp *http.Response, body []byte) error {
+	if !h.acceptStatus(resp.StatusCode) {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	for _, a := range h.ExpectHeaders {
+		values, ok := resp.Header[http.CanonicalHeaderKey(a.Name)]
+		if !ok {
+			return fmt.Errorf("missing header %s", a.Name)
+		}
+		if a.Value != nil && !anyMatch(a.Value, values) {
+			return fmt.Errorf("header %s doesn't match %s", a.Name, a.Value)
+		}
+	}
+
+	if h.ExpectBody != nil && !h.ExpectBody.Match(body) {
+		return fmt.Errorf("body doesn't match %s", h.ExpectBody)
+	}
+	if len(h.ExpectJSON) > 0 {
+		var v any
+		if err := json.Unmarshal(body, &v); err != nil {
+			return fmt.Errorf("invalid JSON body: %w", err)
+		}
+		for _, a := range h.ExpectJSON {
+			value, ok := jsonLookup(v, a.Path)
+			if !ok {
+				return fmt.Errorf("missing JSON path %s", a.Path)
+			}
+			if got := jsonString(value); got != a.Value {
+				return fmt.Errorf("JSON path %s is %q, expected %q", a.Path, got, a.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// update sets the weight of p from the value it reported in resp. A missing or
+// invalid value resets it to the configured weight, the health check isn't
+// failed for it.
+func (r *loadReport) update(p *Peer, resp *http.Response, body []byte) {
+	v, err := r.value(resp, body)
+	if err != nil {
+		log.Debugf("No %s reported by %s: %v", r.Kind, p.Host, err)
+		p.reported.Store(nil)
+		peerWeight.WithLabelValues(p.Host).Set(float64(p.Weight))
+		return
+	}
+
+	w := v
+	if r.Kind == reportLoad {
+		w = float64(p.Weight) * (1 - min(v, 1))
+	}
+	p.reported.Store(&w)
+	peerWeight.WithLabelValues(p.Host).Set(w)
+}
+
+// value returns the value reported in resp.
+func (r *loadReport) value(resp *http.Response, body []byte) (float64, error) {
+	var s string
+	if r.Header != "" {
+		s = resp.Header.Get(r.Header)
+		if s == "" {
+			return 0, fmt.Errorf("missing header %s", r.Header)
+		}
+	} else {
+		var v any
+		if err := json.Unmarshal(body, &v); err != nil {
+			return 0, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		value, ok := jsonLookup(v, r.Path)
+		if !ok {
+			return 0, fmt.Errorf("missing JSON path %s", r.Path)
+		}
+		s = jsonString(value)
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, fmt.Errorf("invalid %s %s", r.Kind, s)
+	}
+	return v, nil
+}
+
+func (h *httpCheck) acceptStatus(code int) bool {
+	if len(h.Status) == 0 {
+		return code == http.StatusOK
+	}
+	for _, r := range h.Status {
+		if code >= r.Low && code <= r.High {
+			return true
+		}
+	}
+	return false
+}
+
+// anyMatch reports whether any of values matches re.
+func anyMatch(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonLookup returns the value at path in v, a decoded JSON document.
+func jsonLookup(v any, path string) (any, bool) {
+	if path == "" || path == "." {
+		return v, true
+	}
+	for _, key := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			child, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// jsonString formats a decoded JSON value the way it is written in the config.
+func jsonString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return "null"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	}
+}
+
+// parseStatusRange parses a status code, or a range of status codes like 200-299.
+func parseStatusRange(s string) (statusRange, error) {
+	low, high, isRange := strings.Cut(s, "-")
+	l, err := strconv.Atoi(low)
+	if err != nil {
+		return statusRange{}, err
+	}
+	h := l
+	if isRange {
+		if h, err = strconv.Atoi(high); err != nil {
+			return statusRange{}, err
+		}
+	}
+	if l < 100 || h > 599 || l > h {
+		return statusRange{}, errors.New("status must be in range [100, 599]")
+	}
+	return statusRange{Low: l, High: h}, nil
+}
@@ -0,0 +1,263 @@
+package zoneregistry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestHTTPCheck(t *testing.T) {
+	tests := []struct {
+		check     *httpCheck
+		handler   http.HandlerFunc
+		shouldErr bool
+	}{
+		{
+			check:     &httpCheck{},
+			handler:   func(w http.ResponseWriter, r *http.Request) {},
+			shouldErr: false,
+		},
+		{
+			check:     &httpCheck{},
+			handler:   func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+			shouldErr: true,
+		},
+		{
+			check:     &httpCheck{Status: []statusRange{{Low: 200, High: 299}}},
+			handler:   func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+			shouldErr: false,
+		},
+		{
+			check:     &httpCheck{Status: []statusRange{{Low: 200, High: 299}}},
+			handler:   func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			shouldErr: true,
+		},
+		// Body assertions
+		{
+			check:     &httpCheck{ExpectBody: regexp.MustCompile(`^ok$`)},
+			handler:   func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") },
+			shouldErr: false,
+		},
+		{
+			check:     &httpCheck{ExpectJSON: []jsonAssertion{{Path: "status", Value: "ok"}}},
+			handler:   func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, `{"status":"degraded"}`) },
+			shouldErr: true,
+		},
+		{
+			check: &httpCheck{ExpectJSON: []jsonAssertion{{Path: "checks.1.ready", Value: "true"}}},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"checks":[{"ready":false},{"ready":true}]}`)
+			},
+			shouldErr: false,
+		},
+		// Header assertions
+		{
+			check:     &httpCheck{ExpectHeaders: []headerAssertion{{Name: "x-ready"}}},
+			handler:   func(w http.ResponseWriter, r *http.Request) {},
+			shouldErr: true,
+		},
+		{
+			check:     &httpCheck{ExpectHeaders: []headerAssertion{{Name: "x-ready", Value: regexp.MustCompile("^yes$")}}},
+			handler:   func(w http.ResponseWriter, r *http.Request) { w.Header().Set("X-Ready", "yes") },
+			shouldErr: false,
+		},
+		// Request options
+		{
+			check: &httpCheck{Method: http.MethodPost, Host: "peer.example.org", Headers: http.Header{"X-Token": {"secret"}}, Body: "ping"},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if r.Method != http.MethodPost || r.Host != "peer.example.org" || r.Header.Get("X-Token") != "secret" || string(body) != "ping" {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			},
+			shouldErr: false,
+		},
+	}
+
+	for i, tc := range tests {
+		s := httptest.NewServer(tc.handler)
+		peer := NewPeer()
+		peer.Port = listenerPort(t, s.Listener.Addr().String())
+
+		err := tc.check.Check(context.TODO(), peer, net.ParseIP("127.0.0.1"))
+		s.Close()
+
+		if tc.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error", i)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+		}
+	}
+}
+
+func TestHTTPCheckKeepAlive(t *testing.T) {
+	var conns atomic.Int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	peer := NewPeer()
+	peer.Port = listenerPort(t, s.Listener.Addr().String())
+
+	check := &httpCheck{}
+	for i := 0; i < 3; i++ {
+		if err := check.Check(context.TODO(), peer, net.ParseIP("127.0.0.1")); err != nil {
+			t.Fatalf("Probe %d: Expected no error, got %v", i, err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("Expected the probes to share 1 connection, got %d", n)
+	}
+	check.CloseIdleConnections()
+}
+
+func TestHTTPCheckReport(t *testing.T) {
+	tests := []struct {
+		report         *loadReport
+		weight         uint32
+		handler        http.HandlerFunc
+		expectedWeight float64
+	}{
+		{
+			report:         &loadReport{Kind: reportCapacity, Path: "capacity"},
+			handler:        func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, `{"capacity":120}`) },
+			expectedWeight: 120,
+		},
+		{
+			report:         &loadReport{Kind: reportLoad, Header: "X-Load"},
+			weight:         10,
+			handler:        func(w http.ResponseWriter, r *http.Request) { w.Header().Set("X-Load", "0.75") },
+			expectedWeight: 2.5,
+		},
+		{
+			report:         &loadReport{Kind: reportLoad, Header: "X-Load"},
+			weight:         10,
+			handler:        func(w http.ResponseWriter, r *http.Request) { w.Header().Set("X-Load", "1.5") },
+			expectedWeight: 0,
+		},
+		// Missing or invalid values fall back to the configured weight
+		{
+			report:         &loadReport{Kind: reportCapacity, Path: "capacity"},
+			weight:         3,
+			handler:        func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, `{}`) },
+			expectedWeight: 3,
+		},
+		{
+			report:         &loadReport{Kind: reportCapacity, Header: "X-Capacity"},
+			weight:         3,
+			handler:        func(w http.ResponseWriter, r *http.Request) { w.Header().Set("X-Capacity", "-1") },
+			expectedWeight: 3,
+		},
+	}
+
+	for i, tc := range tests {
+		s := httptest.NewServer(tc.handler)
+		peer := NewPeer()
+		peer.Weight = tc.weight
+		peer.Port = listenerPort(t, s.Listener.Addr().String())
+
+		check := &httpCheck{Report: tc.report}
+		err := check.Check(context.TODO(), peer, net.ParseIP("127.0.0.1"))
+		check.CloseIdleConnections()
+		s.Close()
+
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+		}
+		if w := peer.weight(); w != tc.expectedWeight {
+			t.Errorf("Test %d: Expected weight %v, got %v", i, tc.expectedWeight, w)
+		}
+	}
+}
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  statusRange
+	}{
+		{input: "204", expected: statusRange{Low: 204, High: 204}},
+		{input: "200-299", expected: statusRange{Low: 200, High: 299}},
+		{input: "299-200", shouldErr: true},
+		{input: "700", shouldErr: true},
+		{input: "ok", shouldErr: true},
+	}
+
+	for i, test := range tests {
+		r, err := parseStatusRange(test.input)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error for input %s", i, test.input)
+		}
+		if !test.shouldErr && r != test.expected {
+			t.Errorf("Test %d, expected %v, got: %v", i, test.expected, r)
+		}
+	}
+}
+
+func TestHTTPCheckTLS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+
+	tests := []struct {
+		host      string
+		tls       *tls.Config
+		shouldErr bool
+	}{
+		// The test certificate is valid for example.com
+		{host: "example.com.", tls: &tls.Config{RootCAs: roots}, shouldErr: false},
+		{host: "peer.example.org.", tls: &tls.Config{RootCAs: roots}, shouldErr: true},
+		{host: "peer.example.org.", tls: &tls.Config{RootCAs: roots, ServerName: "example.com"}, shouldErr: false},
+		{host: "peer.example.org.", tls: &tls.Config{InsecureSkipVerify: true}, shouldErr: false},
+		{host: "example.com.", tls: nil, shouldErr: true},
+	}
+
+	for i, tc := range tests {
+		peer := NewPeer()
+		peer.Host = tc.host
+		peer.Protocol = "https"
+		peer.Port = listenerPort(t, s.Listener.Addr().String())
+		peer.TLS = tc.tls
+
+		err := (&httpCheck{}).Check(context.TODO(), peer, net.ParseIP("127.0.0.1"))
+		if tc.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error", i)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+		}
+	}
+
+	if days := gaugeValue(certificateExpiry.WithLabelValues("example.com.")); days <= 0 {
+		t.Errorf("Expected the certificate expiry to be exported, got: %f days", days)
+	}
+}
+
+// gaugeValue returns the current value of g.
+func gaugeValue(g prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil {
+		return 0
+	}
+	return m.GetGauge().GetValue()
+}
@@ -0,0 +1,70 @@
+package zoneregistry
+
+import (
+	"maps"
+	"slices"
+)
+
+// sourceFile is the source of the peers loaded from the peers file.
+const sourceFile = "file"
+
+// setPeers replaces the peers coming from source. The registry's peers are
+// rebuilt from the peers of the Corefile followed by the peers of every
+// source, and a new health snapshot is published right away. Peers keep their
+// health as long as the same *Peer is given again, and the connections kept
+// open by the health checks of the peers dropped are closed. The metric series
+// of the hosts no longer declared are deleted. A peer whose host is already
+// declared is left out.
+func (zr *ZoneRegistry) setPeers(source string, peers []*Peer) {
+	zr.mu.Lock()
+	if zr.sources == nil {
+		zr.sources = map[string][]*Peer{}
+	}
+
+	dynamic := map[*Peer]bool{}
+	for _, ps := range zr.sources {
+		for _, p := range ps {
+			dynamic[p] = true
+		}
+	}
+	hosts := map[string]bool{}
+	var merged []*Peer
+	for _, p := range zr.Peers {
+		if !dynamic[p] {
+			merged = append(merged, p)
+			hosts[p.Host] = true
+		}
+	}
+
+	zr.sources[source] = peers
+	for _, name := range slices.Sorted(maps.Keys(zr.sources)) {
+		for _, p := range zr.sources[name] {
+			if hosts[p.Host] {
+				log.Warningf("Ignoring peer %s from %s, its host is already declared", p.Host, name)
+				continue
+			}
+			merged = append(merged, p)
+			hosts[p.Host] = true
+		}
+	}
+	kept := make(map[*Peer]bool, len(merged))
+	for _, p := range merged {
+		kept[p] = true
+	}
+	var dropped []*Peer
+	for _, p := range zr.Peers {
+		if !kept[p] {
+			dropped = append(dropped, p)
+		}
+	}
+	zr.Peers = merged
+	zr.mu.Unlock()
+
+	zr.publishHealth()
+	for _, p := range dropped {
+		p.closeIdleConnections()
+		if !hosts[p.Host] {
+			deletePeerMetrics(p.Host)
+		}
+	}
+}
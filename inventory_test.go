@@ -0,0 +1,39 @@
+package zoneregistry
+
+import "testing"
+
+func TestSetPeers(t *testing.T) {
+	newPeer := func(host string) *Peer {
+		p := NewPeer()
+		p.Host = host
+		return p
+	}
+	static := newPeer("static.example.org.")
+
+	zr := newZoneRegistry()
+	zr.Peers = []*Peer{static}
+	zr.setPeers("b", []*Peer{newPeer("b.example.org.")})
+	zr.setPeers("a", []*Peer{newPeer("a.example.org."), newPeer("static.example.org.")})
+
+	expected := []string{"static.example.org.", "a.example.org.", "b.example.org."}
+	if len(zr.Peers) != len(expected) {
+		t.Fatalf("Expected %d peers, got %d", len(expected), len(zr.Peers))
+	}
+	for i, host := range expected {
+		if zr.Peers[i].Host != host {
+			t.Errorf("Expected peer %s at %d, got %s", host, i, zr.Peers[i].Host)
+		}
+	}
+	if zr.Peers[0] != static {
+		t.Errorf("Expected the Corefile peer to win over a duplicate")
+	}
+
+	peerWeight.WithLabelValues("a.example.org.").Set(1)
+	zr.setPeers("a", nil)
+	if len(zr.Peers) != 2 || len(zr.health.Load().peers) != 2 {
+		t.Errorf("Expected the peers of a source to be removed and the snapshot published")
+	}
+	if peerWeight.DeleteLabelValues("a.example.org.") {
+		t.Errorf("Expected the series of the removed peer to be deleted")
+	}
+}
@@ -41,6 +41,60 @@ var (
 		Help:      "Number of unhealthy peers",
 	}, []string{"role"},
 	)
+	healthCheckSuccesses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "health_check_successes_total",
+		Help:      "Counter of successful health checks per address family and attempt.",
+	}, []string{"peer", "family", "attempt"},
+	)
+	healthCheckFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "health_check_failures_total",
+		Help:      "Counter of health checks failed after all attempts.",
+	}, []string{"peer"},
+	)
+	certificateExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "certificate_expiry_days",
+		Help:      "Number of days until the certificate presented by the peer to HTTPS health checks expires.",
+	}, []string{"peer"},
+	)
+	healthCheckRTT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "health_check_rtt_seconds",
+		Help:      "Histogram of the round-trip time of successful health checks.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+	}, []string{"peer"},
+	)
+	checkHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "check_healthy",
+		Help:      "Result of the last run of each health check of the peers combining several checks, 1 if it succeeded.",
+	}, []string{"peer", "check", "family"},
+	)
+	peerWeight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "peer_weight",
+		Help:      "Weight of the peer derived from the load or capacity it reported in its last health check.",
+	}, []string{"peer"},
+	)
 )
 
 var once sync.Once
+
+// deletePeerMetrics deletes the series of the peer whose host is host.
+func deletePeerMetrics(host string) {
+	labels := prometheus.Labels{"peer": host}
+	healthCheckSuccesses.DeletePartialMatch(labels)
+	healthCheckFailures.DeletePartialMatch(labels)
+	certificateExpiry.DeletePartialMatch(labels)
+	healthCheckRTT.DeletePartialMatch(labels)
+	checkHealthy.DeletePartialMatch(labels)
+	peerWeight.DeletePartialMatch(labels)
+}
@@ -2,9 +2,11 @@ package zoneregistry
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
 	"net"
-	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,82 +15,275 @@ var (
 	protocolDefault = "http"
 	pathDefault     = "/health"
 	portDefault     = uint32(8080)
+	dnsPortDefault  = uint32(53)
+	weightDefault   = uint32(1)
 )
 
 type Peer struct {
 	Host    string
 	Role    string
 	Healthy bool
+	Checked bool
 	Labels  []string
+	Weight  uint32
+	// Zone is the subzone delegated to the peer, its Host if empty.
+	Zone string
 
 	Protocol string
 	Path     string
 	Port     uint32
+	DNSPort  uint32
 
 	IPv4 net.IP
 	IPv6 net.IP
+
+	Check HealthChecker
+	TLS   *tls.Config
+	// Retries overrides the number of retries of the registry if set.
+	Retries *uint32
+
+	// Rise and Fall are the number of consecutive successful or failed health
+	// checks needed to change the peer's health. Hold is the minimum time
+	// spent in each state, extended by dampening when the peer flaps.
+	Rise          uint32
+	Fall          uint32
+	Hold          time.Duration
+	DampeningBase time.Duration
+	DampeningMax  time.Duration
+
+	state healthState
+	// mu guards Healthy, Checked and state, written by the health checks
+	// while the health snapshot may be published.
+	mu sync.Mutex
+
+	// resolved holds the addresses the host resolved to, used when neither
+	// IPv4 nor IPv6 is configured.
+	resolved atomic.Pointer[resolvedAddrs]
+
+	// reported is the weight derived from the load or capacity reported by
+	// the peer in its last health check, if any.
+	reported atomic.Pointer[float64]
+
+	// rtt is the smoothed round-trip time of the successful probes, in
+	// nanoseconds, zero until the first one.
+	rtt atomic.Int64
+
+	// defaultCheck is the check of peers without Check, kept with the peer
+	// for its connections to be reused.
+	defaultCheck httpCheck
 }
 
 func NewPeer() *Peer {
 	return &Peer{
 		Role:     roleDefault,
+		Weight:   weightDefault,
 		Protocol: protocolDefault,
 		Path:     pathDefault,
 		Port:     portDefault,
+		DNSPort:  dnsPortDefault,
+		Rise:     riseDefault,
+		Fall:     fallDefault,
 	}
 }
 
-func (p Peer) isHealthy(c *http.Client) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
-	defer cancel()
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// resolvedAddrs holds the addresses of a peer's host, sorted.
+type resolvedAddrs struct {
+	IPv4 []net.IP
+	IPv6 []net.IP
+}
 
-	urls := []string{}
-	// Prioritize IPv6
-	if p.IPv6 != nil {
-		url := fmt.Sprintf("%s://[%s]:%d%s", p.Protocol, p.IPv6.String(), p.Port, p.Path)
-		urls = append(urls, url)
+// addrs returns the addresses of the peer in family: the configured ones, or
+// the ones its host resolved to when none is configured.
+func (p *Peer) addrs(family string) []net.IP {
+	if !p.needsResolution() {
+		switch {
+		case family == familyIPv4 && p.IPv4 != nil:
+			return []net.IP{p.IPv4}
+		case family == familyIPv6 && p.IPv6 != nil:
+			return []net.IP{p.IPv6}
+		}
+		return nil
 	}
-	if p.IPv4 != nil {
-		url := fmt.Sprintf("%s://%s:%d%s", p.Protocol, p.IPv4.String(), p.Port, p.Path)
-		urls = append(urls, url)
+
+	r := p.resolved.Load()
+	switch {
+	case r == nil:
+		return nil
+	case family == familyIPv4:
+		return r.IPv4
+	default:
+		return r.IPv6
 	}
-	results := make(chan bool, len(urls))
-
-	for _, url := range urls {
-		go func(u string) {
-			req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
-			if err != nil {
-				log.Debugf("health check request creation failed for %s: %v", u, err)
-				results <- false
-				return
-			}
+}
 
-			resp, err := c.Do(req)
-			if err != nil {
-				log.Debugf("Health check failed for %s: %v", u, err)
-				results <- false
-				return
+// zone returns the subzone delegated to the peer.
+func (p *Peer) zone() string {
+	if p.Zone != "" {
+		return p.Zone
+	}
+	return p.Host
+}
+
+// needsResolution reports whether the addresses of the peer come from its host.
+func (p *Peer) needsResolution() bool { return p.IPv4 == nil && p.IPv6 == nil }
+
+// rttWeight is the weight of the latest probe in the smoothed round-trip time.
+const rttWeight = 0.3
+
+// probeOptions controls the attempts of a health check.
+type probeOptions struct {
+	Timeout time.Duration // Deadline of each attempt, none if zero
+	Retries uint32        // Attempts made after the first one failed
+	Backoff time.Duration // Delay before the first retry, doubled on each retry
+}
+
+// isHealthy runs the peer's health check, retrying failed attempts, and reports
+// whether any attempt succeeded on any address. The result of the last attempt
+// is recorded for each address and address family. Peers without a check get
+// the HTTP check.
+func (p *Peer) isHealthy(ctx context.Context, opts probeOptions) bool {
+	checker := p.checker()
+
+	// Only the last attempt counts towards the health of each address
+	var addrs map[string]bool
+	defer func() {
+		p.mu.Lock()
+		p.recordAddrs(addrs)
+		p.mu.Unlock()
+	}()
+
+	backoff := opts.Backoff
+	for attempt := uint32(1); ; attempt++ {
+		var rtt time.Duration
+		addrs, rtt = p.probe(ctx, checker, opts.Timeout)
+
+		healthy := false
+		for family, ok := range addressFamilies(addrs) {
+			if ok {
+				log.Debugf("Health check of %s succeeded over %s on attempt %d", p.Host, family, attempt)
+				healthCheckSuccesses.WithLabelValues(p.Host, family, strconv.Itoa(int(attempt))).Inc()
+				healthy = true
 			}
-			defer resp.Body.Close()
+		}
+		if healthy {
+			p.observeRTT(rtt)
+			return true
+		}
+		if attempt > opts.Retries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	log.Debugf("Health check of %s failed after %d attempts", p.Host, opts.Retries+1)
+	healthCheckFailures.WithLabelValues(p.Host).Inc()
+	return false
+}
+
+// weight returns the weight of the peer for the weighted balancing, the one
+// derived from its last report if any.
+func (p *Peer) weight() float64 {
+	if w := p.reported.Load(); w != nil {
+		return *w
+	}
+	return float64(p.Weight)
+}
+
+// checker returns the health check of the peer, the HTTP check by default.
+func (p *Peer) checker() HealthChecker {
+	if p.Check == nil {
+		return &p.defaultCheck
+	}
+	return p.Check
+}
+
+// closeIdleConnections closes the connections kept open by the peer's health
+// check. Connections of a probe in progress are left open until they idle out.
+func (p *Peer) closeIdleConnections() {
+	if c, ok := p.checker().(idleCloser); ok {
+		c.CloseIdleConnections()
+	}
+}
 
-			log.Debugf("%s - %d", u, resp.StatusCode)
-			if resp.StatusCode == http.StatusOK {
-				results <- true
+// RTT returns the smoothed round-trip time of the peer's successful probes, or
+// zero if none succeeded yet.
+func (p *Peer) RTT() time.Duration { return time.Duration(p.rtt.Load()) }
+
+// observeRTT accounts for the round-trip time of a successful probe in the
+// exponentially weighted moving average of the peer's RTT.
+func (p *Peer) observeRTT(rtt time.Duration) {
+	healthCheckRTT.WithLabelValues(p.Host).Observe(rtt.Seconds())
+
+	if old := p.RTT(); old > 0 {
+		rtt = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(old))
+	}
+	p.rtt.Store(int64(max(rtt, 1)))
+}
+
+// probe runs a single attempt of checker on each of the peer's addresses
+// concurrently and returns the result of each address, with the round-trip
+// time of the fastest successful one. Checks of the whole peer run once.
+func (p *Peer) probe(ctx context.Context, checker HealthChecker, timeout time.Duration) (map[string]bool, time.Duration) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx = withProbeRuns(ctx)
+
+	type result struct {
+		addr string
+		ok   bool
+		rtt  time.Duration
+	}
+
+	addrs := map[string]net.IP{}
+	for _, family := range allFamilies {
+		for _, ip := range p.addrs(family) {
+			addrs[ip.String()] = ip
+		}
+	}
+	results := make(chan result, len(addrs))
+
+	for addr, ip := range addrs {
+		go func() {
+			start := time.Now()
+			if err := checker.Check(ctx, p, ip); err != nil {
+				log.Debugf("Health check failed for %s (%s): %v", p.Host, ip, err)
+				results <- result{addr: addr}
 				return
 			}
-			results <- false
-		}(url)
+			results <- result{addr: addr, ok: true, rtt: time.Since(start)}
+		}()
 	}
 
-	for range urls {
+	// Addresses without a result by the deadline are failed
+	healthy := make(map[string]bool, len(addrs))
+	for addr := range addrs {
+		healthy[addr] = false
+	}
+	var rtt time.Duration
+	for range addrs {
 		select {
-		case success := <-results:
-			if success {
-				return true
+		case r := <-results:
+			healthy[r.addr] = r.ok
+			if r.ok && (rtt == 0 || r.rtt < rtt) {
+				rtt = r.rtt
 			}
 		case <-ctx.Done():
-			return false
+			return healthy, rtt
 		}
 	}
-	return false
+	return healthy, rtt
 }
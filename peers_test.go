@@ -1,7 +1,14 @@
 package zoneregistry
 
 import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestPeers(t *testing.T) {
@@ -26,3 +33,104 @@ func TestPeers(t *testing.T) {
 
 	}
 }
+
+// flakyCheck fails its first failures calls, and blocks until the deadline of
+// the attempt when block is set.
+type flakyCheck struct {
+	failures int32
+	block    bool
+	calls    atomic.Int32
+}
+
+func (f *flakyCheck) Check(ctx context.Context, p *Peer, ip net.IP) error {
+	if f.calls.Add(1) > f.failures {
+		return nil
+	}
+	if f.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return errors.New("flaky")
+}
+
+func TestIsHealthyRetries(t *testing.T) {
+	tests := []struct {
+		check         *flakyCheck
+		opts          probeOptions
+		expected      bool
+		expectedCalls int32
+	}{
+		{
+			check:         &flakyCheck{failures: 0},
+			opts:          probeOptions{},
+			expected:      true,
+			expectedCalls: 1,
+		},
+		{
+			check:         &flakyCheck{failures: 1},
+			opts:          probeOptions{},
+			expected:      false,
+			expectedCalls: 1,
+		},
+		{
+			check:         &flakyCheck{failures: 2},
+			opts:          probeOptions{Retries: 2, Backoff: time.Millisecond},
+			expected:      true,
+			expectedCalls: 3,
+		},
+		{
+			check:         &flakyCheck{failures: 1, block: true},
+			opts:          probeOptions{Timeout: 10 * time.Millisecond, Retries: 1, Backoff: time.Millisecond},
+			expected:      true,
+			expectedCalls: 2,
+		},
+	}
+
+	for i, test := range tests {
+		peer := NewPeer()
+		peer.Host = "example.org."
+		peer.IPv4 = net.ParseIP("127.0.0.1")
+		peer.Check = test.check
+
+		if healthy := peer.isHealthy(context.TODO(), test.opts); healthy != test.expected {
+			t.Errorf("Test %d, expected healthy=%v, got: %v", i, test.expected, healthy)
+		}
+		if calls := test.check.calls.Load(); calls != test.expectedCalls {
+			t.Errorf("Test %d, expected %d attempts, got: %d", i, test.expectedCalls, calls)
+		}
+	}
+}
+
+func TestObserveRTT(t *testing.T) {
+	peer := NewPeer()
+	peer.Host = "peer.example.org."
+
+	peer.observeRTT(100 * time.Millisecond)
+	if rtt := peer.RTT(); rtt != 100*time.Millisecond {
+		t.Errorf("Expected the first RTT to be kept as is, got %s", rtt)
+	}
+	peer.observeRTT(200 * time.Millisecond)
+	if rtt := peer.RTT(); rtt != 130*time.Millisecond {
+		t.Errorf("Expected a smoothed RTT of 130ms, got %s", rtt)
+	}
+}
+
+func TestIsHealthyPerAddress(t *testing.T) {
+	s, peer := newTestHealthServer(t, http.StatusOK)
+	defer s.Close()
+
+	// Only 127.0.0.1 accepts the health checks
+	peer.IPv4 = nil
+	peer.resolved.Store(&resolvedAddrs{IPv4: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}})
+
+	if !peer.isHealthy(context.TODO(), probeOptions{Timeout: time.Second}) {
+		t.Fatalf("Expected the peer to be healthy on one of its addresses")
+	}
+	expected := map[string]bool{"127.0.0.1": true, "127.0.0.2": false}
+	if !reflect.DeepEqual(peer.state.addrs, expected) {
+		t.Errorf("Expected address results %v, got %v", expected, peer.state.addrs)
+	}
+	if failed := peer.failedAddrs(); !reflect.DeepEqual(failed, map[string]bool{"127.0.0.2": true}) {
+		t.Errorf("Expected 127.0.0.2 to be failed, got %v", failed)
+	}
+}
@@ -0,0 +1,445 @@
+package zoneregistry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"gopkg.in/yaml.v3"
+)
+
+// reloadDefault is how often the peers file is checked for changes.
+var reloadDefault = 5 * time.Second
+
+// peersFile loads peers from a YAML or JSON file. The peers that didn't change
+// from one load to the next are kept as is, with their health.
+type peersFile struct {
+	Path   string
+	Reload time.Duration
+
+	sum     [sha256.Size]byte
+	entries map[string]peerEntry
+	peers   map[string]*Peer
+}
+
+// peersDocument is the content of a peers file.
+type peersDocument struct {
+	Peers []peerEntry `yaml:"peers"`
+}
+
+// peerEntry is a peer as declared in a peers file or registered through the
+// API, with the options of a peer block of the Corefile.
+type peerEntry struct {
+	Host          string   `yaml:"host" json:"host"`
+	Role          string   `yaml:"role" json:"role"`
+	Labels        []string `yaml:"labels" json:"labels"`
+	Weight        *uint32  `yaml:"weight" json:"weight"`
+	IPv4          string   `yaml:"ipv4" json:"ipv4"`
+	IPv6          string   `yaml:"ipv6" json:"ipv6"`
+	Protocol      string   `yaml:"protocol" json:"protocol"`
+	Path          string   `yaml:"path" json:"path"`
+	Port          uint32   `yaml:"port" json:"port"`
+	DNSPort       uint32   `yaml:"dns_port" json:"dns_port"`
+	Rise          uint32   `yaml:"rise" json:"rise"`
+	Fall          uint32   `yaml:"fall" json:"fall"`
+	Hold          string   `yaml:"hold" json:"hold"`
+	DampeningBase string   `yaml:"dampening_base" json:"dampening_base"`
+	DampeningMax  string   `yaml:"dampening_max" json:"dampening_max"`
+	Retries       *uint32  `yaml:"retries" json:"retries"`
+
+	TLS    *tlsEntry    `yaml:"tls" json:"tls"`
+	Check  []checkEntry `yaml:"check" json:"check"`
+	Checks string       `yaml:"checks" json:"checks"`
+}
+
+// tlsEntry is the tls block of a peer entry.
+type tlsEntry struct {
+	CA                 string `yaml:"ca" json:"ca"`
+	Cert               string `yaml:"cert" json:"cert"`
+	Key                string `yaml:"key" json:"key"`
+	ServerName         string `yaml:"server_name" json:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+}
+
+// checkEntry is a check block of a peer entry. Type is one of the check types,
+// and Name defaults to it.
+type checkEntry struct {
+	Type string `yaml:"type" json:"type"`
+	Name string `yaml:"name" json:"name"`
+	Port uint32 `yaml:"port" json:"port"`
+
+	httpCheckEntry `yaml:",inline"`
+
+	Transport string   `yaml:"transport" json:"transport"`
+	Service   string   `yaml:"service" json:"service"`
+	Command   []string `yaml:"command" json:"command"`
+}
+
+// httpCheckEntry holds the options of a check entry specific to HTTP checks.
+// Status holds codes or ranges such as "200-299", ExpectJSON the expected
+// value at each path, and ExpectHeader a regular expression per header name,
+// which only needs to be present when it is empty.
+type httpCheckEntry struct {
+	Protocol     string            `yaml:"protocol" json:"protocol"`
+	Path         string            `yaml:"path" json:"path"`
+	Method       string            `yaml:"method" json:"method"`
+	Host         string            `yaml:"host" json:"host"`
+	Headers      map[string]string `yaml:"headers" json:"headers"`
+	Body         string            `yaml:"body" json:"body"`
+	Status       []string          `yaml:"status" json:"status"`
+	ExpectBody   string            `yaml:"expect_body" json:"expect_body"`
+	ExpectJSON   map[string]string `yaml:"expect_json" json:"expect_json"`
+	ExpectHeader map[string]string `yaml:"expect_header" json:"expect_header"`
+	Capacity     *reportEntry      `yaml:"capacity" json:"capacity"`
+	Load         *reportEntry      `yaml:"load" json:"load"`
+}
+
+// reportEntry is where a peer reports its capacity or load, one of the JSON
+// path or the header.
+type reportEntry struct {
+	JSON   string `yaml:"json" json:"json"`
+	Header string `yaml:"header" json:"header"`
+}
+
+// load reads the file and returns its peers. It reports whether the file
+// changed since the previous load, no peers being returned when it didn't.
+// Nothing is kept from a file that fails to load.
+func (f *peersFile) load() ([]*Peer, bool, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, false, err
+	}
+	sum := sha256.Sum256(data)
+	if f.entries != nil && sum == f.sum {
+		return nil, false, nil
+	}
+
+	// YAML being a superset of JSON, both are decoded the same way
+	var doc peersDocument
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, err
+	}
+
+	entries := make(map[string]peerEntry, len(doc.Peers))
+	peers := make(map[string]*Peer, len(doc.Peers))
+	order := make([]string, 0, len(doc.Peers))
+	for i, e := range doc.Peers {
+		peer, err := e.peer()
+		if err != nil {
+			return nil, false, fmt.Errorf("peer %d: %w", i, err)
+		}
+		if _, ok := entries[peer.Host]; ok {
+			return nil, false, fmt.Errorf("duplicate peer %s", peer.Host)
+		}
+		if prev, ok := f.peers[peer.Host]; ok && reflect.DeepEqual(f.entries[peer.Host], e) {
+			peer = prev
+		}
+		entries[peer.Host] = e
+		peers[peer.Host] = peer
+		order = append(order, peer.Host)
+	}
+
+	f.sum, f.entries, f.peers = sum, entries, peers
+	list := make([]*Peer, len(order))
+	for i, host := range order {
+		list[i] = peers[host]
+	}
+	return list, true, nil
+}
+
+// peer returns the peer declared by e, validated like a peer block.
+func (e peerEntry) peer() (*Peer, error) {
+	peer := NewPeer()
+	h := plugin.Host(e.Host).NormalizeExact()
+	if e.Host == "" || len(h) == 0 {
+		return nil, fmt.Errorf("invalid host: %q", e.Host)
+	}
+	peer.Host = h[0]
+	peer.Labels = e.Labels
+
+	if e.Role != "" {
+		if e.Role != "primary" && e.Role != "secondary" {
+			return nil, fmt.Errorf("role must be ['primary', 'secondary']: %s", e.Role)
+		}
+		peer.Role = e.Role
+	}
+	if e.Weight != nil {
+		if *e.Weight > 65535 {
+			return nil, fmt.Errorf("weight must be in range [0, 65535]: %d", *e.Weight)
+		}
+		peer.Weight = *e.Weight
+	}
+	if e.IPv4 != "" {
+		ip := net.ParseIP(e.IPv4)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4: %s", e.IPv4)
+		}
+		peer.IPv4 = ip
+	}
+	if e.IPv6 != "" {
+		ip := net.ParseIP(e.IPv6)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6: %s", e.IPv6)
+		}
+		peer.IPv6 = ip
+	}
+	if e.Protocol != "" {
+		if e.Protocol != "http" && e.Protocol != "https" {
+			return nil, fmt.Errorf("protocol must be ['http', 'https']: %s", e.Protocol)
+		}
+		peer.Protocol = e.Protocol
+	}
+	if e.Path != "" {
+		peer.Path = e.Path
+	}
+	if e.Port > 65535 || e.DNSPort > 65535 {
+		return nil, fmt.Errorf("port must be in range [0, 65535]: %d", max(e.Port, e.DNSPort))
+	}
+	if e.Port != 0 {
+		peer.Port = e.Port
+	}
+	if e.DNSPort != 0 {
+		peer.DNSPort = e.DNSPort
+	}
+	if e.Rise > 100 || e.Fall > 100 {
+		return nil, fmt.Errorf("rise and fall must be in range [1, 100]: %d %d", e.Rise, e.Fall)
+	}
+	if e.Rise != 0 {
+		peer.Rise = e.Rise
+	}
+	if e.Fall != 0 {
+		peer.Fall = e.Fall
+	}
+
+	if e.Hold != "" {
+		d, err := time.ParseDuration(e.Hold)
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("hold must be positive: %s", d)
+		}
+		peer.Hold = d
+	}
+	if e.DampeningBase != "" || e.DampeningMax != "" {
+		base, err := time.ParseDuration(e.DampeningBase)
+		if err != nil {
+			return nil, err
+		}
+		max, err := time.ParseDuration(e.DampeningMax)
+		if err != nil {
+			return nil, err
+		}
+		if base <= 0 || max < base {
+			return nil, fmt.Errorf("dampening must satisfy 0 < BASE <= MAX: %s %s", base, max)
+		}
+		peer.DampeningBase, peer.DampeningMax = base, max
+	}
+	if e.Retries != nil {
+		if *e.Retries > 10 {
+			return nil, fmt.Errorf("retries must be in range [0, 10]: %d", *e.Retries)
+		}
+		peer.Retries = e.Retries
+	}
+
+	if e.TLS != nil {
+		if (e.TLS.Cert == "") != (e.TLS.Key == "") {
+			return nil, errors.New("tls cert and key must be set together")
+		}
+		cfg, err := newTLSConfig(e.TLS.CA, e.TLS.Cert, e.TLS.Key, e.TLS.ServerName, e.TLS.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		peer.TLS = cfg
+	}
+
+	composite := &compositeCheck{Policy: policyAll}
+	for _, ce := range e.Check {
+		name, check, err := ce.check()
+		if err != nil {
+			return nil, err
+		}
+		for _, nc := range composite.Checks {
+			if nc.Name == name {
+				return nil, fmt.Errorf("duplicate check name %s, checks of the same type must be named", name)
+			}
+		}
+		composite.Checks = append(composite.Checks, namedCheck{Name: name, Check: check})
+	}
+	if e.Checks != "" {
+		args := strings.Fields(e.Checks)
+		switch {
+		case len(args) == 1 && (args[0] == policyAll || args[0] == policyAny):
+			composite.Policy = args[0]
+		case len(args) == 2 && args[0] == policyQuorum:
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return nil, err
+			}
+			if n < 1 || n > len(composite.Checks) {
+				return nil, fmt.Errorf("quorum must be in range [1, %d]: %d", len(composite.Checks), n)
+			}
+			composite.Policy, composite.Quorum = policyQuorum, n
+		default:
+			return nil, fmt.Errorf("checks must be ['%s', '%s', '%s N']: %s", policyAll, policyAny, policyQuorum, e.Checks)
+		}
+	}
+	peer.Check = composite.peerCheck()
+	return peer, nil
+}
+
+// check returns the name and the health check declared by e, validated like a
+// check block.
+func (e checkEntry) check() (string, HealthChecker, error) {
+	check := newHealthChecker(e.Type)
+	if check == nil {
+		return "", nil, fmt.Errorf("check must be ['%s', '%s', '%s', '%s', '%s']: %s", checkHTTP, checkTCP, checkDNS, checkGRPC, checkExec, e.Type)
+	}
+	name := e.Type
+	if e.Name != "" {
+		name = e.Name
+	}
+	if e.Port > 65535 {
+		return "", nil, fmt.Errorf("port must be in range [0, 65535]: %d", e.Port)
+	}
+
+	// Options of another type of check are refused
+	_, isHTTP := check.(*httpCheck)
+	_, isDNS := check.(*dnsCheck)
+	_, isGRPC := check.(*grpcCheck)
+	_, isExec := check.(*execCheck)
+	switch {
+	case !isHTTP && !reflect.DeepEqual(e.httpCheckEntry, httpCheckEntry{}):
+		return "", nil, fmt.Errorf("%s check has options only supported by %s checks", name, checkHTTP)
+	case !isDNS && e.Transport != "":
+		return "", nil, fmt.Errorf("transport is only supported by %s checks", checkDNS)
+	case !isGRPC && e.Service != "":
+		return "", nil, fmt.Errorf("service is only supported by %s checks", checkGRPC)
+	case !isExec && len(e.Command) > 0:
+		return "", nil, fmt.Errorf("command is only supported by %s checks", checkExec)
+	case isExec && e.Port != 0:
+		return "", nil, fmt.Errorf("port is not supported by %s checks", checkExec)
+	}
+
+	switch check := check.(type) {
+	case *httpCheck:
+		check.Port = e.Port
+		if err := e.httpCheckEntry.apply(check); err != nil {
+			return "", nil, err
+		}
+	case *tcpCheck:
+		check.Port = e.Port
+	case *dnsCheck:
+		if e.Transport != "" && e.Transport != "udp" && e.Transport != "tcp" {
+			return "", nil, fmt.Errorf("transport must be ['udp', 'tcp']: %s", e.Transport)
+		}
+		check.Port, check.Transport = e.Port, e.Transport
+	case *grpcCheck:
+		check.Port, check.Service = e.Port, e.Service
+	case *execCheck:
+		if len(e.Command) == 0 {
+			return "", nil, fmt.Errorf("%s checks require a command", checkExec)
+		}
+		check.Command, check.Args = e.Command[0], e.Command[1:]
+	}
+	return name, check, nil
+}
+
+// apply sets the options of e on h.
+func (e httpCheckEntry) apply(h *httpCheck) error {
+	if e.Protocol != "" && e.Protocol != "http" && e.Protocol != "https" {
+		return fmt.Errorf("protocol must be ['http', 'https']: %s", e.Protocol)
+	}
+	h.Protocol, h.Path, h.Host, h.Body = e.Protocol, e.Path, e.Host, e.Body
+	h.Method = strings.ToUpper(e.Method)
+
+	for _, name := range slices.Sorted(maps.Keys(e.Headers)) {
+		if h.Headers == nil {
+			h.Headers = http.Header{}
+		}
+		h.Headers.Add(name, e.Headers[name])
+	}
+	for _, status := range e.Status {
+		r, err := parseStatusRange(status)
+		if err != nil {
+			return fmt.Errorf("invalid status %s: %v", status, err)
+		}
+		h.Status = append(h.Status, r)
+	}
+	if e.ExpectBody != "" {
+		re, err := regexp.Compile(e.ExpectBody)
+		if err != nil {
+			return err
+		}
+		h.ExpectBody = re
+	}
+	for _, path := range slices.Sorted(maps.Keys(e.ExpectJSON)) {
+		h.ExpectJSON = append(h.ExpectJSON, jsonAssertion{Path: path, Value: e.ExpectJSON[path]})
+	}
+	for _, name := range slices.Sorted(maps.Keys(e.ExpectHeader)) {
+		a := headerAssertion{Name: name}
+		if e.ExpectHeader[name] != "" {
+			re, err := regexp.Compile(e.ExpectHeader[name])
+			if err != nil {
+				return err
+			}
+			a.Value = re
+		}
+		h.ExpectHeaders = append(h.ExpectHeaders, a)
+	}
+
+	if e.Capacity != nil && e.Load != nil {
+		return fmt.Errorf("%s and %s can't both be reported", reportCapacity, reportLoad)
+	}
+	for kind, r := range map[string]*reportEntry{reportCapacity: e.Capacity, reportLoad: e.Load} {
+		if r == nil {
+			continue
+		}
+		if (r.JSON == "") == (r.Header == "") {
+			return fmt.Errorf("%s must have one of json or header", kind)
+		}
+		h.Report = &loadReport{Kind: kind, Path: r.JSON, Header: r.Header}
+	}
+	return nil
+}
+
+// watchPeersFile reloads the peers file every Reload until ctx is cancelled.
+// A file that fails to load is logged and the previous peers are kept.
+func (zr *ZoneRegistry) watchPeersFile(ctx context.Context) {
+	ticker := time.NewTicker(zr.PeersFile.Reload)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		peers, changed, err := zr.PeersFile.load()
+		if err != nil {
+			log.Errorf("Failed to reload %s, keeping the previous peers: %v", zr.PeersFile.Path, err)
+			continue
+		}
+		if changed {
+			zr.setPeers(sourceFile, peers)
+			log.Infof("Reloaded %d peers from %s", len(peers), zr.PeersFile.Path)
+		}
+	}
+}
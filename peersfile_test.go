@@ -0,0 +1,193 @@
+package zoneregistry
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeersFileLoad(t *testing.T) {
+	tests := []struct {
+		content       string
+		shouldErr     bool
+		expectedHosts []string
+	}{
+		{
+			content: `
+peers:
+  - host: peer1.example.org
+    ipv4: 10.0.0.1
+    labels: [env=prod]
+  - host: peer2.example.org
+    role: secondary
+    weight: 0
+    hold: 30s
+`,
+			expectedHosts: []string{"peer1.example.org.", "peer2.example.org."},
+		},
+		{
+			content:       `{"peers": [{"host": "peer1.example.org", "ipv6": "2001:db8::1", "port": 8443}]}`,
+			expectedHosts: []string{"peer1.example.org."},
+		},
+		{
+			content: `
+peers:
+  - host: peer1.example.org
+    retries: 2
+    tls:
+      server_name: peer1.internal
+      insecure_skip_verify: true
+    checks: quorum 1
+    check:
+      - type: http
+        protocol: https
+        status: ["200-299"]
+        expect_json: {status: ok}
+        expect_header: {X-Ready: ""}
+        load: {header: X-Load}
+      - type: exec
+        command: [/usr/local/bin/check-replication, --max-lag, "30"]
+`,
+			expectedHosts: []string{"peer1.example.org."},
+		},
+		{content: ``, expectedHosts: nil},
+		// Error tests
+		{content: `peers: [{host: peer1.example.org, check: [{type: exec}]}]`, shouldErr: true},
+		{content: `peers: [{host: peer1.example.org, check: [{type: tcp, path: /health}]}]`, shouldErr: true},
+		{content: `peers: [{host: peer1.example.org, check: [{type: tcp}, {type: tcp}]}]`, shouldErr: true},
+		{content: `peers: [{host: peer1.example.org, check: [{type: tcp}], checks: quorum 2}]`, shouldErr: true},
+		{content: `peers: [{host: peer1.example.org, tls: {cert: cert.pem}}]`, shouldErr: true},
+		{content: `peers: [{host: peer1.example.org, retries: 11}]`, shouldErr: true},
+		{content: `peers: [{host: peer1.example.org, role: asdf}]`, shouldErr: true},
+		{content: `peers: [{host: peer1.example.org, ipv4: "2001:db8::1"}]`, shouldErr: true},
+		{content: `peers: [{host: peer1.example.org, colour: blue}]`, shouldErr: true},
+		{content: `peers: [{host: peer1.example.org}, {host: PEER1.example.org.}]`, shouldErr: true},
+		{content: `peers: [{ipv4: 10.0.0.1}]`, shouldErr: true},
+	}
+
+	for i, test := range tests {
+		path := filepath.Join(t.TempDir(), "peers.yaml")
+		if err := os.WriteFile(path, []byte(test.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		f := &peersFile{Path: path}
+		peers, changed, err := f.load()
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if !changed {
+			t.Errorf("Test %d: Expected the first load to report a change", i)
+		}
+		if len(peers) != len(test.expectedHosts) {
+			t.Errorf("Test %d: Expected %d peers, got %d", i, len(test.expectedHosts), len(peers))
+			continue
+		}
+		for j, host := range test.expectedHosts {
+			if peers[j].Host != host {
+				t.Errorf("Test %d: Expected peer %s, got %s", i, host, peers[j].Host)
+			}
+		}
+	}
+}
+
+func TestPeerEntryChecks(t *testing.T) {
+	retries := uint32(2)
+	e := peerEntry{
+		Host:    "peer1.example.org",
+		Retries: &retries,
+		TLS:     &tlsEntry{ServerName: "peer1.internal"},
+		Checks:  "quorum 1",
+		Check: []checkEntry{
+			{Type: checkHTTP, httpCheckEntry: httpCheckEntry{Protocol: "https", Load: &reportEntry{Header: "X-Load"}}},
+			{Type: checkExec, Name: "replication", Command: []string{"check-replication", "--max-lag", "30"}},
+		},
+	}
+	peer, err := e.peer()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if peer.Retries == nil || *peer.Retries != 2 {
+		t.Errorf("Expected 2 retries, got %v", peer.Retries)
+	}
+	if peer.TLS == nil || peer.TLS.ServerName != "peer1.internal" {
+		t.Errorf("Expected the TLS server name to be set, got %v", peer.TLS)
+	}
+	cc, ok := peer.Check.(*compositeCheck)
+	if !ok || len(cc.Checks) != 2 || cc.Policy != policyQuorum || cc.Quorum != 1 {
+		t.Fatalf("Expected a quorum of 1 of 2 checks, got %+v", peer.Check)
+	}
+	if h, ok := cc.Checks[0].Check.(*httpCheck); !ok || h.Protocol != "https" || h.Report == nil || h.Report.Header != "X-Load" {
+		t.Errorf("Expected an HTTPS check reporting its load, got %+v", cc.Checks[0].Check)
+	}
+	if x, ok := cc.Checks[1].Check.(*execCheck); !ok || cc.Checks[1].Name != "replication" || x.Command != "check-replication" || len(x.Args) != 2 {
+		t.Errorf("Expected the replication exec check, got %+v", cc.Checks[1])
+	}
+}
+
+func TestPeersFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`peers: [{host: peer1.example.org, ipv4: 10.0.0.1}, {host: peer2.example.org, ipv4: 10.0.0.2}]`)
+
+	zr := newZoneRegistry()
+	static := NewPeer()
+	static.Host = "static.example.org."
+	zr.Peers = []*Peer{static}
+	zr.PeersFile = &peersFile{Path: path, Reload: 10 * time.Millisecond}
+
+	peers, _, err := zr.PeersFile.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr.setPeers(sourceFile, peers)
+	peer1 := zr.Peers[1]
+	peer1.Healthy, peer1.Checked = true, true
+
+	// peer1 is unchanged, peer2 is modified and peer3 is added
+	write(`peers: [{host: peer1.example.org, ipv4: 10.0.0.1}, {host: peer2.example.org, ipv4: 10.0.0.22}, {host: peer3.example.org}]`)
+	if err := zr.OnStartup(); err != nil {
+		t.Fatal(err)
+	}
+	defer zr.OnShutdown()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		zr.mu.RLock()
+		n := len(zr.Peers)
+		zr.mu.RUnlock()
+		if n == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the peers file to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	zr.mu.RLock()
+	defer zr.mu.RUnlock()
+	if zr.Peers[0] != static {
+		t.Errorf("Expected the Corefile peer to be kept first")
+	}
+	if zr.Peers[1] != peer1 {
+		t.Errorf("Expected the unchanged peer to keep its state")
+	}
+	if !zr.Peers[2].IPv4.Equal(net.ParseIP("10.0.0.22")) {
+		t.Errorf("Expected the modified peer to be updated, got %s", zr.Peers[2].IPv4)
+	}
+}
@@ -0,0 +1,87 @@
+package zoneregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+var errNoPeerAddress = errors.New("no peer address to forward to")
+
+// serveProxy forwards the query to peers and relays the first answer to the client.
+func (zr *ZoneRegistry) serveProxy(ctx context.Context, w dns.ResponseWriter, state request.Request, zone string, start time.Time, peers []*Peer) (int, error) {
+	resp, err := zr.proxy(ctx, state, peers)
+	if err != nil {
+		log.Errorf("Failed to proxy %s: %s", state.QName(), err)
+		return dns.RcodeServerFailure, err
+	}
+	return zr.writeMsg(ctx, w, state.Scrub(resp), zone, start)
+}
+
+// proxy sends the query to each peer address in order, over the transport used
+// by the client, until one of them answers. A peer answering with SERVFAIL or
+// REFUSED is passed over too, its answer is only relayed when no other peer
+// answers. Each attempt is bounded by the timeout.
+func (zr *ZoneRegistry) proxy(ctx context.Context, state request.Request, peers []*Peer) (*dns.Msg, error) {
+	timeout := time.Duration(zr.Timeout) * time.Second
+
+	var failed *dns.Msg
+	err := errNoPeerAddress
+	for _, peer := range peers {
+		for _, addr := range peer.dnsAddrs() {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			resp, exErr := forward(ctx, state, addr, timeout)
+			if exErr != nil {
+				log.Debugf("Forwarding %s to %s (%s) failed: %v", state.QName(), peer.Host, addr, exErr)
+				err = fmt.Errorf("%s: %w", peer.Host, exErr)
+				continue
+			}
+			if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+				log.Debugf("Forwarding %s to %s (%s) got %s", state.QName(), peer.Host, addr, dns.RcodeToString[resp.Rcode])
+				failed = resp
+				continue
+			}
+			log.Debugf("Forwarded %s to %s (%s)", state.QName(), peer.Host, addr)
+			return resp, nil
+		}
+	}
+	if failed != nil {
+		return failed, nil
+	}
+	return nil, err
+}
+
+// forward sends the query to addr over the client's transport, and again over
+// TCP when the answer is truncated.
+func forward(ctx context.Context, state request.Request, addr string, timeout time.Duration) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client := &dns.Client{Net: state.Proto(), Timeout: timeout}
+	resp, _, err := client.ExchangeContext(ctx, state.Req, addr)
+	if err == nil && resp.Truncated && client.Net == "udp" {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, state.Req, addr)
+	}
+	return resp, err
+}
+
+// dnsAddrs returns the addresses of the peer's DNS server, IPv6 first.
+func (p *Peer) dnsAddrs() []string {
+	port := strconv.Itoa(int(p.DNSPort))
+	addrs := []string{}
+	for _, family := range []string{familyIPv6, familyIPv4} {
+		for _, ip := range p.addrs(family) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return addrs
+}
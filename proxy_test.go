@@ -0,0 +1,149 @@
+package zoneregistry
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSProxyMode(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Authoritative = true
+		ret.Answer = append(ret.Answer, test.A("app.example.org. 30 IN A 10.1.1.1"))
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	_, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+
+	zr := newTestZoneRegistry()
+	zr.Mode = modeProxy
+
+	// The first peer has no DNS server listening, forcing a retry on the second
+	dead := zr.Peers[0]
+	dead.IPv4 = net.ParseIP("127.0.0.1")
+	dead.DNSPort = 1
+	alive := NewPeer()
+	alive.Host = "peer2.example.org."
+	alive.IPv4 = net.ParseIP("127.0.0.1")
+	alive.DNSPort = uint32(p)
+	alive.Healthy = true
+	zr.Peers = append(zr.Peers, alive)
+	zr.publishHealth()
+
+	for i := 0; i < len(zr.Peers); i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("app.example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := zr.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != "10.1.1.1" {
+			t.Errorf("Test %d: Expected the peer answer to be relayed, got %v", i, rec.Msg.Answer)
+		}
+	}
+}
+
+// newPeerServer starts a DNS server on UDP and TCP with handler, and returns
+// its port.
+func newPeerServer(t *testing.T, handler dns.HandlerFunc) uint32 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*dns.Server{{Listener: ln, Handler: handler}, {PacketConn: pc, Handler: handler}} {
+		started := make(chan struct{})
+		s.NotifyStartedFunc = func() { close(started) }
+		go s.ActivateAndServe()
+		t.Cleanup(func() { s.Shutdown() })
+		<-started
+	}
+	return uint32(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestProxyFailover(t *testing.T) {
+	answer := func(rcode int) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			ret := new(dns.Msg)
+			ret.SetRcode(r, rcode)
+			if rcode == dns.RcodeSuccess {
+				ret.Answer = []dns.RR{test.A("app.example.org. 30 IN A 10.1.1.1")}
+			}
+			w.WriteMsg(ret)
+		}
+	}
+	// Answers over UDP are truncated, the answer only comes over TCP
+	truncating := func(w dns.ResponseWriter, r *dns.Msg) {
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			ret.Truncated = true
+			w.WriteMsg(ret)
+			return
+		}
+		answer(dns.RcodeSuccess)(w, r)
+	}
+	newPeer := func(host string, handler dns.HandlerFunc) *Peer {
+		p := NewPeer()
+		p.Host = host
+		p.IPv4 = net.ParseIP("127.0.0.1")
+		p.DNSPort = newPeerServer(t, handler)
+		return p
+	}
+	servfail := newPeer("servfail.example.org.", answer(dns.RcodeServerFailure))
+	refused := newPeer("refused.example.org.", answer(dns.RcodeRefused))
+	alive := newPeer("alive.example.org.", answer(dns.RcodeSuccess))
+	truncated := newPeer("truncated.example.org.", truncating)
+
+	tests := []struct {
+		peers         []*Peer
+		expectedRcode int
+	}{
+		{peers: []*Peer{servfail, refused, alive}, expectedRcode: dns.RcodeSuccess},
+		{peers: []*Peer{truncated}, expectedRcode: dns.RcodeSuccess},
+		{peers: []*Peer{servfail, refused}, expectedRcode: dns.RcodeRefused},
+	}
+
+	zr := newTestZoneRegistry()
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("app.example.org.", dns.TypeA)
+		state := request.Request{W: &test.ResponseWriter{}, Req: m}
+		resp, err := zr.proxy(context.TODO(), state, tc.peers)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if resp.Rcode != tc.expectedRcode {
+			t.Errorf("Test %d: Expected rcode %s, got %s", i, dns.RcodeToString[tc.expectedRcode], dns.RcodeToString[resp.Rcode])
+		}
+		if tc.expectedRcode == dns.RcodeSuccess && (resp.Truncated || len(resp.Answer) != 1) {
+			t.Errorf("Test %d: Expected the full answer, got %v", i, resp)
+		}
+	}
+
+	// Nothing is forwarded once the query is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := new(dns.Msg)
+	m.SetQuestion("app.example.org.", dns.TypeA)
+	if _, err := zr.proxy(ctx, request.Request{W: &test.ResponseWriter{}, Req: m}, []*Peer{alive}); err == nil {
+		t.Errorf("Expected a cancelled query not to be forwarded")
+	}
+}
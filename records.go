@@ -0,0 +1,132 @@
+package zoneregistry
+
+import (
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// serveService synthesizes the answer of the query types that are answered by
+// the registry itself for a service name, rather than delegated to peers. It
+// returns false when the query must be delegated.
+func (zr *ZoneRegistry) serveService(msg *dns.Msg, state request.Request, peers []*Peer) bool {
+	switch state.QType() {
+	case dns.TypeDS:
+		// The registry is the parent side of the delegation and holds no DS
+		// records, leave the answer empty for an authoritative NODATA.
+		return true
+
+	case dns.TypeSRV:
+		for _, peer := range peers {
+			msg.Answer = append(msg.Answer, zr.srvRecord(state.QName(), peer))
+			msg.Extra = append(msg.Extra, zr.peerAddressRecords(peer.Host, dns.TypeANY, peer, zr.Glue)...)
+		}
+		return true
+
+	case dns.TypeHTTPS:
+		for _, peer := range peers {
+			msg.Answer = append(msg.Answer, zr.httpsRecord(state.QName(), peer))
+			msg.Extra = append(msg.Extra, zr.peerAddressRecords(peer.Host, dns.TypeANY, peer, zr.Glue)...)
+		}
+		return true
+
+	case dns.TypeTXT:
+		for _, peer := range peers {
+			msg.Answer = append(msg.Answer, zr.txtRecord(state.QName(), append([]string{"peer=" + peer.Host}, peer.Labels...)))
+		}
+		return true
+	}
+	return false
+}
+
+// addressRecords returns the A and AAAA records of name matching qtype. TypeANY
+// returns both families.
+func (zr *ZoneRegistry) addressRecords(name string, qtype uint16, ipv4, ipv6 net.IP) []dns.RR {
+	var rrs []dns.RR
+	if ipv4 != nil && (qtype == dns.TypeA || qtype == dns.TypeANY) {
+		rrs = append(rrs, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: zr.TTL}, A: ipv4})
+	}
+	if ipv6 != nil && (qtype == dns.TypeAAAA || qtype == dns.TypeANY) {
+		rrs = append(rrs, &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: zr.TTL}, AAAA: ipv6})
+	}
+	return rrs
+}
+
+// allFamilies lists both address families, IPv4 first.
+var allFamilies = []string{familyIPv4, familyIPv6}
+
+// peerAddressRecords returns the address records of name matching qtype for
+// the peer's addresses in families, in that order. An address family that
+// failed its last health check is left out while the other one passed it, and
+// so is an address while another one of its family passed it.
+func (zr *ZoneRegistry) peerAddressRecords(name string, qtype uint16, peer *Peer, families []string) []dns.RR {
+	failed, down := "", map[string]bool(nil)
+	if snap := zr.health.Load(); snap != nil {
+		failed, down = snap.failed[peer], snap.down[peer]
+	}
+
+	var rrs []dns.RR
+	for _, family := range families {
+		if family == failed {
+			continue
+		}
+		for _, ip := range peer.addrs(family) {
+			switch {
+			case down[ip.String()]:
+				continue
+			case family == familyIPv4:
+				rrs = append(rrs, zr.addressRecords(name, qtype, ip, nil)...)
+			case family == familyIPv6:
+				rrs = append(rrs, zr.addressRecords(name, qtype, nil, ip)...)
+			}
+		}
+	}
+	return rrs
+}
+
+// srvRecord returns the SRV record of name pointing to the peer's health check
+// port, weighted by the peer's weight.
+func (zr *ZoneRegistry) srvRecord(name string, peer *Peer) *dns.SRV {
+	return &dns.SRV{
+		Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: zr.TTL},
+		Priority: peer.priority(),
+		Weight:   uint16(peer.Weight),
+		Port:     uint16(peer.Port),
+		Target:   peer.Host,
+	}
+}
+
+// httpsRecord returns the HTTPS record of name pointing to the peer's health
+// check port, in service mode.
+func (zr *ZoneRegistry) httpsRecord(name string, peer *Peer) *dns.HTTPS {
+	return &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: zr.TTL},
+		Priority: peer.priority(),
+		Target:   peer.Host,
+		Value:    []dns.SVCBKeyValue{&dns.SVCBPort{Port: uint16(peer.Port)}},
+	}}
+}
+
+// priority returns the priority of the peer in SRV and HTTPS records, the
+// primary peers being preferred to the secondary ones.
+func (p *Peer) priority() uint16 {
+	if p.Role == "secondary" {
+		return 20
+	}
+	return 10
+}
+
+// txtRecord returns a TXT record of name holding txt. An empty txt gets a single
+// empty string, since a TXT record can't be empty.
+func (zr *ZoneRegistry) txtRecord(name string, txt []string) *dns.TXT {
+	if len(txt) == 0 {
+		txt = []string{""}
+	}
+	return &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: zr.TTL}, Txt: txt}
+}
+
+// hinfoRecord returns the minimal answer to ANY queries described in RFC 8482.
+func (zr *ZoneRegistry) hinfoRecord(name string) *dns.HINFO {
+	return &dns.HINFO{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: zr.TTL}, Cpu: "RFC8482"}
+}
@@ -0,0 +1,474 @@
+package zoneregistry
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+)
+
+const (
+	// sourceRegistration is the source of the peers registered through the API.
+	sourceRegistration = "registration"
+
+	// leaseDefault is how long a registration lasts without a heartbeat.
+	leaseDefault = time.Minute
+	// signatureSkew is the maximum age of a signed request.
+	signatureSkew = 5 * time.Minute
+
+	authSecret = "secret"
+	authHMAC   = "hmac"
+
+	headerTimestamp = "X-Zoneregistry-Timestamp"
+	headerSignature = "X-Zoneregistry-Signature"
+)
+
+// registration serves the API through which peers register themselves, on
+// Addr. A registration lasts for Lease unless renewed, by registering again or
+// by a heartbeat. Requests are authenticated with Secret, sent as a bearer
+// token or used as the key of an HMAC-SHA256 signature, depending on Auth.
+type registration struct {
+	Addr   string
+	Auth   string
+	Secret string
+	Lease  time.Duration
+
+	zr     *ZoneRegistry
+	mu     sync.Mutex
+	leases map[string]*lease
+	server *http.Server
+	done   chan struct{}
+	now    func() time.Time
+
+	// seen holds the signatures of the HMAC signed requests accepted, until
+	// their timestamp is too old for them to be replayed.
+	seen map[string]time.Time
+}
+
+// handover keeps the state of a registration API stopped for a reload, by
+// address, for the instance taking over the address. Registered peers thus
+// survive reloads without having to register again. The state left behind by
+// a reload that removed or moved the API is dropped when the previous
+// instance shuts down.
+var handover = struct {
+	sync.Mutex
+	states map[string]handoverState
+}{states: map[string]handoverState{}}
+
+// handoverState is the state of a registration API handed over.
+type handoverState struct {
+	leases map[string]*lease
+	seen   map[string]time.Time
+}
+
+// lease is the registration of a peer.
+type lease struct {
+	entry   peerEntry
+	peer    *Peer
+	expires time.Time
+}
+
+// registrationResponse is the response to a registration or a heartbeat.
+type registrationResponse struct {
+	Host    string    `json:"host"`
+	Expires time.Time `json:"expires"`
+}
+
+// startRegistration starts the registration API, if enabled.
+func (zr *ZoneRegistry) startRegistration() error {
+	if zr.Registration == nil {
+		return nil
+	}
+	return zr.Registration.start(zr)
+}
+
+// stopRegistration stops the registration API, if running.
+func (zr *ZoneRegistry) stopRegistration() error {
+	if zr.Registration == nil {
+		return nil
+	}
+	return zr.Registration.stop(false)
+}
+
+// suspendRegistration stops the registration API before a reload, the new
+// instance starting before this one shuts down. The leases are handed over to
+// the new instance, or back to this one if the reload fails.
+func (zr *ZoneRegistry) suspendRegistration() error {
+	if zr.Registration == nil {
+		return nil
+	}
+	return zr.Registration.stop(true)
+}
+
+func (r *registration) start(zr *ZoneRegistry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.server != nil {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", r.Addr)
+	if err != nil {
+		return err
+	}
+	r.zr = zr
+	if r.leases == nil {
+		r.leases = map[string]*lease{}
+	}
+	if r.seen == nil {
+		r.seen = map[string]time.Time{}
+	}
+	if r.now == nil {
+		r.now = time.Now
+	}
+	if r.adopt() {
+		zr.setPeers(sourceRegistration, r.peers())
+	}
+
+	r.server = &http.Server{Handler: r.handler(), ReadHeaderTimeout: 10 * time.Second}
+	r.done = make(chan struct{})
+
+	go r.server.Serve(ln)
+	go r.expire(r.done)
+	log.Infof("Registration API listening on %s", ln.Addr())
+	return nil
+}
+
+// stop stops the API, handing its state over when keep is set. Otherwise the
+// state handed over for Addr and not taken over is dropped.
+func (r *registration) stop(keep bool) error {
+	r.mu.Lock()
+	server, done := r.server, r.done
+	r.server, r.done = nil, nil
+	switch {
+	case server != nil && keep:
+		state := handoverState{
+			leases: make(map[string]*lease, len(r.leases)),
+			seen:   maps.Clone(r.seen),
+		}
+		for host, l := range r.leases {
+			c := *l
+			state.leases[host] = &c
+		}
+		handover.Lock()
+		handover.states[r.Addr] = state
+		handover.Unlock()
+	case !keep:
+		handover.Lock()
+		delete(handover.states, r.Addr)
+		handover.Unlock()
+	}
+	r.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	close(done)
+	return server.Close()
+}
+
+// adopt takes over the state handed over for Addr, if any. A peer is rebuilt
+// from its registration unless it is already registered the same way. The
+// caller must hold r.mu.
+func (r *registration) adopt() bool {
+	handover.Lock()
+	state, ok := handover.states[r.Addr]
+	delete(handover.states, r.Addr)
+	handover.Unlock()
+	if !ok {
+		return false
+	}
+
+	maps.Copy(r.seen, state.seen)
+	adopted := make(map[string]*lease, len(state.leases))
+	for host, l := range state.leases {
+		if prev, ok := r.leases[host]; ok && reflect.DeepEqual(prev.entry, l.entry) {
+			adopted[host] = &lease{entry: l.entry, peer: prev.peer, expires: l.expires}
+			continue
+		}
+		peer, err := l.entry.peer()
+		if err != nil {
+			continue
+		}
+		adopted[host] = &lease{entry: l.entry, peer: peer, expires: l.expires}
+	}
+	r.leases = adopted
+	return true
+}
+
+// handler returns the handler of the API's endpoints.
+func (r *registration) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /v1/peers/{host}", r.authenticated(r.register))
+	mux.HandleFunc("POST /v1/peers/{host}/heartbeat", r.authenticated(r.heartbeat))
+	mux.HandleFunc("DELETE /v1/peers/{host}", r.authenticated(r.deregister))
+	return mux
+}
+
+// authenticated checks the credentials of the request before calling next.
+func (r *registration) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxBodySize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.verify(req, body); err != nil {
+			log.Warningf("Rejected registration request from %s: %v", req.RemoteAddr, err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req.Body = io.NopCloser(strings.NewReader(string(body)))
+		next(w, req)
+	}
+}
+
+// verify checks the credentials of req, whose body is body.
+func (r *registration) verify(req *http.Request, body []byte) error {
+	if r.Auth == authSecret {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(r.Secret)) != 1 {
+			return errors.New("invalid token")
+		}
+		return nil
+	}
+
+	ts, err := strconv.ParseInt(req.Header.Get(headerTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %w", err)
+	}
+	if age := r.now().Sub(time.Unix(ts, 0)); age > signatureSkew || age < -signatureSkew {
+		return fmt.Errorf("timestamp is %s off", age)
+	}
+	signature, err := hex.DecodeString(req.Header.Get(headerSignature))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	if !hmac.Equal(signature, sign(r.Secret, ts, req.Method, req.URL.Path, body)) {
+		return errors.New("invalid signature")
+	}
+
+	// A signed request is only accepted once
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := hex.EncodeToString(signature)
+	if _, ok := r.seen[key]; ok {
+		return errors.New("replayed signature")
+	}
+	r.seen[key] = time.Unix(ts, 0).Add(signatureSkew)
+	return nil
+}
+
+// sign returns the HMAC-SHA256 signature of a request, computed over its
+// timestamp, method, path and body separated by newlines.
+func sign(secret string, ts int64, method, path string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n", ts, method, path)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// register creates or renews the registration of a peer. A peer registered
+// again with the same settings keeps its health.
+func (r *registration) register(w http.ResponseWriter, req *http.Request) {
+	host, ok := r.host(w, req)
+	if !ok {
+		return
+	}
+	var e peerEntry
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&e); err != nil {
+		http.Error(w, fmt.Sprintf("invalid registration: %v", err), http.StatusBadRequest)
+		return
+	}
+	if e.Host == "" {
+		e.Host = host
+	}
+	// Peers must not run commands on the registry
+	if slices.ContainsFunc(e.Check, func(c checkEntry) bool { return c.Type == checkExec }) {
+		http.Error(w, fmt.Sprintf("invalid registration: %s checks can't be registered", checkExec), http.StatusBadRequest)
+		return
+	}
+	// nor make it read its files
+	if e.TLS != nil && (e.TLS.CA != "" || e.TLS.Cert != "" || e.TLS.Key != "") {
+		http.Error(w, "invalid registration: tls ca, cert and key can't be registered", http.StatusBadRequest)
+		return
+	}
+	peer, err := e.peer()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid registration: %v", err), http.StatusBadRequest)
+		return
+	}
+	if peer.Host != host {
+		http.Error(w, "host doesn't match the path", http.StatusBadRequest)
+		return
+	}
+	e.Host = host
+
+	r.mu.Lock()
+	l, ok := r.leases[host]
+	changed := !ok || !reflect.DeepEqual(l.entry, e)
+	if changed {
+		if r.zr.declared(host, r.peerOf(host)) {
+			r.mu.Unlock()
+			http.Error(w, "host is already declared", http.StatusConflict)
+			return
+		}
+		l = &lease{entry: e, peer: peer}
+		r.leases[host] = l
+		log.Infof("Peer %s registered from %s", host, req.RemoteAddr)
+	}
+	l.expires = r.now().Add(r.Lease)
+	expires := l.expires
+	peers := r.peers()
+	r.mu.Unlock()
+
+	if changed {
+		r.zr.setPeers(sourceRegistration, peers)
+	}
+	writeJSON(w, registrationResponse{Host: host, Expires: expires})
+}
+
+// heartbeat renews the registration of a peer.
+func (r *registration) heartbeat(w http.ResponseWriter, req *http.Request) {
+	host, ok := r.host(w, req)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	var expires time.Time
+	l, ok := r.leases[host]
+	if ok {
+		l.expires = r.now().Add(r.Lease)
+		expires = l.expires
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "peer is not registered", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, registrationResponse{Host: host, Expires: expires})
+}
+
+// deregister removes the registration of a peer.
+func (r *registration) deregister(w http.ResponseWriter, req *http.Request) {
+	host, ok := r.host(w, req)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	_, ok = r.leases[host]
+	delete(r.leases, host)
+	peers := r.peers()
+	r.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "peer is not registered", http.StatusNotFound)
+		return
+	}
+	r.zr.setPeers(sourceRegistration, peers)
+	log.Infof("Peer %s deregistered", host)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expire removes the registrations whose lease ran out until done is closed.
+func (r *registration) expire(done chan struct{}) {
+	ticker := time.NewTicker(max(r.Lease/10, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		r.expireLeases()
+	}
+}
+
+// expireLeases removes the registrations whose lease ran out, and forgets the
+// signatures too old to be replayed.
+func (r *registration) expireLeases() {
+	r.mu.Lock()
+	now := r.now()
+	maps.DeleteFunc(r.seen, func(_ string, until time.Time) bool { return now.After(until) })
+	expired := false
+	for host, l := range r.leases {
+		if now.After(l.expires) {
+			log.Infof("Registration of peer %s expired", host)
+			delete(r.leases, host)
+			expired = true
+		}
+	}
+	peers := r.peers()
+	r.mu.Unlock()
+
+	if expired {
+		r.zr.setPeers(sourceRegistration, peers)
+	}
+}
+
+// host returns the normalized host of the request's path.
+func (r *registration) host(w http.ResponseWriter, req *http.Request) (string, bool) {
+	h := plugin.Host(req.PathValue("host")).NormalizeExact()
+	if len(h) == 0 {
+		http.Error(w, "invalid host", http.StatusBadRequest)
+		return "", false
+	}
+	return h[0], true
+}
+
+// peers returns the registered peers, sorted by host. The caller must hold r.mu.
+func (r *registration) peers() []*Peer {
+	peers := make([]*Peer, 0, len(r.leases))
+	for _, l := range r.leases {
+		peers = append(peers, l.peer)
+	}
+	slices.SortFunc(peers, func(a, b *Peer) int { return strings.Compare(a.Host, b.Host) })
+	return peers
+}
+
+// peerOf returns the registered peer of host, if any. The caller must hold r.mu.
+func (r *registration) peerOf(host string) *Peer {
+	if l, ok := r.leases[host]; ok {
+		return l.peer
+	}
+	return nil
+}
+
+// declared reports whether host is the host of one of the registry's peers
+// other than self.
+func (zr *ZoneRegistry) declared(host string, self *Peer) bool {
+	zr.mu.RLock()
+	defer zr.mu.RUnlock()
+	for _, p := range zr.Peers {
+		if p.Host == host && p != self {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
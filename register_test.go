@@ -0,0 +1,214 @@
+package zoneregistry
+
+import (
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistration(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	static := NewPeer()
+	static.Host = "static.example.org."
+
+	zr := newZoneRegistry()
+	zr.Peers = []*Peer{static}
+	r := &registration{Auth: authSecret, Secret: "s3cr3t", Lease: time.Minute, zr: zr, leases: map[string]*lease{}, now: func() time.Time { return now }}
+	s := httptest.NewServer(r.handler())
+	defer s.Close()
+
+	do := func(method, path, token, body string) int {
+		req, _ := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	hosts := func() []string {
+		zr.mu.RLock()
+		defer zr.mu.RUnlock()
+		var hosts []string
+		for _, p := range zr.Peers {
+			hosts = append(hosts, p.Host)
+		}
+		return hosts
+	}
+
+	tests := []struct {
+		method, path, token, body string
+		expectedStatus            int
+	}{
+		{"PUT", "/v1/peers/a.example.org", "wrong", `{"ipv4": "10.0.0.1"}`, http.StatusUnauthorized},
+		{"PUT", "/v1/peers/a.example.org", "s3cr3t", `{"ipv4": "not an ip"}`, http.StatusBadRequest},
+		{"PUT", "/v1/peers/a.example.org", "s3cr3t", `{"ipv4": "10.0.0.1", "unknown": 1}`, http.StatusBadRequest},
+		{"PUT", "/v1/peers/a.example.org", "s3cr3t", `{"host": "b.example.org", "ipv4": "10.0.0.1"}`, http.StatusBadRequest},
+		{"PUT", "/v1/peers/static.example.org", "s3cr3t", `{"ipv4": "10.0.0.9"}`, http.StatusConflict},
+		{"POST", "/v1/peers/a.example.org/heartbeat", "s3cr3t", "", http.StatusNotFound},
+		{"PUT", "/v1/peers/a.example.org", "s3cr3t", `{"ipv4": "10.0.0.1", "check": [{"type": "exec", "command": ["true"]}]}`, http.StatusBadRequest},
+		{"PUT", "/v1/peers/a.example.org", "s3cr3t", `{"ipv4": "10.0.0.1", "tls": {"ca": "/etc/hostname"}}`, http.StatusBadRequest},
+		{"PUT", "/v1/peers/a.example.org", "s3cr3t", `{"ipv4": "10.0.0.1", "role": "secondary", "dns_port": 5353}`, http.StatusOK},
+		{"PUT", "/v1/peers/b.example.org", "s3cr3t", `{"ipv4": "10.0.0.2", "tls": {"server_name": "b.internal"}, "check": [{"type": "http", "protocol": "https", "status": ["200-299"]}]}`, http.StatusOK},
+		{"POST", "/v1/peers/a.example.org/heartbeat", "s3cr3t", "", http.StatusOK},
+	}
+	for i, test := range tests {
+		if status := do(test.method, test.path, test.token, test.body); status != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, status)
+		}
+	}
+	if got := hosts(); strings.Join(got, " ") != "static.example.org. a.example.org. b.example.org." {
+		t.Fatalf("Expected the registered peers after the static one, got %v", got)
+	}
+	a := zr.Peers[1]
+	if a.Role != "secondary" || a.DNSPort != 5353 {
+		t.Errorf("Expected the registered settings, got role %s and dns_port %d", a.Role, a.DNSPort)
+	}
+	if b := zr.Peers[2]; b.TLS == nil || b.TLS.ServerName != "b.internal" || b.Check == nil {
+		t.Errorf("Expected the registered check and TLS settings, got %+v %+v", b.Check, b.TLS)
+	}
+
+	// Registering again the same way keeps the peer and its health
+	do("PUT", "/v1/peers/a.example.org", "s3cr3t", `{"ipv4": "10.0.0.1", "role": "secondary", "dns_port": 5353}`)
+	if zr.Peers[1] != a {
+		t.Errorf("Expected a renewed registration to keep the peer")
+	}
+
+	// Only a, renewed by the heartbeat, outlives the lease of b
+	now = now.Add(30 * time.Second)
+	do("POST", "/v1/peers/a.example.org/heartbeat", "s3cr3t", "")
+	now = now.Add(31 * time.Second)
+	r.expireLeases()
+	if got := hosts(); strings.Join(got, " ") != "static.example.org. a.example.org." {
+		t.Errorf("Expected b to expire, got %v", got)
+	}
+
+	if status := do("DELETE", "/v1/peers/a.example.org", "s3cr3t", ""); status != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, status)
+	}
+	if got := hosts(); len(got) != 1 {
+		t.Errorf("Expected only the static peer left, got %v", got)
+	}
+}
+
+func TestRegistrationHMAC(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := &registration{Auth: authHMAC, Secret: "s3cr3t", seen: map[string]time.Time{}, now: func() time.Time { return now }}
+	body := []byte(`{"ipv4": "10.0.0.1"}`)
+
+	tests := []struct {
+		ts, secret, path string
+		shouldErr        bool
+	}{
+		{ts: "1700000000", secret: "s3cr3t", path: "/v1/peers/a.example.org"},
+		{ts: "1700000200", secret: "s3cr3t", path: "/v1/peers/a.example.org"},
+		{ts: "1700000000", secret: "wrong", path: "/v1/peers/a.example.org", shouldErr: true},
+		{ts: "1699999000", secret: "s3cr3t", path: "/v1/peers/a.example.org", shouldErr: true},
+		{ts: "not a timestamp", secret: "s3cr3t", path: "/v1/peers/a.example.org", shouldErr: true},
+	}
+	for i, test := range tests {
+		ts, _ := strconv.ParseInt(test.ts, 10, 64)
+		req := httptest.NewRequest("PUT", "/v1/peers/a.example.org", nil)
+		req.Header.Set(headerTimestamp, test.ts)
+		req.Header.Set(headerSignature, hex.EncodeToString(sign(test.secret, ts, "PUT", test.path, body)))
+		if err := r.verify(req, body); (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: Expected error %t, got %v", i, test.shouldErr, err)
+		}
+	}
+
+	// The signature covers the body
+	req := httptest.NewRequest("PUT", "/v1/peers/a.example.org", nil)
+	req.Header.Set(headerTimestamp, "1700000000")
+	req.Header.Set(headerSignature, hex.EncodeToString(sign("s3cr3t", now.Unix(), "PUT", "/v1/peers/a.example.org", body)))
+	if err := r.verify(req, []byte(`{"ipv4": "10.0.0.2"}`)); err == nil {
+		t.Errorf("Expected a tampered body to be rejected")
+	}
+
+	// A signed request can't be replayed, until its timestamp is too old anyway
+	if err := r.verify(req, body); err == nil {
+		t.Errorf("Expected a replayed request to be rejected")
+	}
+	now = now.Add(signatureSkew + time.Second)
+	r.expireLeases()
+	if len(r.seen) != 1 {
+		t.Errorf("Expected only the signature of the latest request to be kept, got %d", len(r.seen))
+	}
+}
+
+func TestRegistrationHandover(t *testing.T) {
+	entry := peerEntry{Host: "a.example.org.", IPv4: "10.0.0.1"}
+	peer, _ := entry.peer()
+	expires := time.Now().Add(time.Minute)
+
+	old := newZoneRegistry()
+	old.Registration = &registration{Addr: "127.0.0.1:0", Auth: authSecret, Secret: "s3cr3t", Lease: time.Minute}
+	if err := old.startRegistration(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	old.Registration.mu.Lock()
+	old.Registration.leases[entry.Host] = &lease{entry: entry, peer: peer, expires: expires}
+	old.Registration.mu.Unlock()
+
+	// The new instance starts after the old one is suspended, and before its shutdown
+	if err := old.suspendRegistration(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	zr := newZoneRegistry()
+	zr.Registration = &registration{Addr: "127.0.0.1:0", Auth: authSecret, Secret: "s3cr3t", Lease: time.Minute}
+	if err := zr.startRegistration(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer zr.stopRegistration()
+	old.stopRegistration()
+
+	if len(zr.Peers) != 1 || zr.Peers[0].Host != entry.Host || zr.Peers[0] == peer {
+		t.Fatalf("Expected the registered peer to be rebuilt by the new instance, got %v", zr.Peers)
+	}
+	if l := zr.Registration.leases[entry.Host]; !l.expires.Equal(expires) {
+		t.Errorf("Expected the lease to expire at %s, got %s", expires, l.expires)
+	}
+}
+
+func TestRegistrationRemoved(t *testing.T) {
+	old := newZoneRegistry()
+	old.Registration = &registration{Addr: "127.0.0.1:0", Auth: authSecret, Secret: "s3cr3t", Lease: time.Minute}
+	if err := old.startRegistration(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The new instance has no registration API, the leases handed over are
+	// dropped once the old instance shuts down
+	if err := old.suspendRegistration(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	old.stopRegistration()
+
+	handover.Lock()
+	defer handover.Unlock()
+	if _, ok := handover.states[old.Registration.Addr]; ok {
+		t.Errorf("Expected the state handed over to be dropped")
+	}
+}
+
+func TestRegistrationStartupFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	zr := newZoneRegistry()
+	zr.Registration = &registration{Addr: ln.Addr().String(), Auth: authSecret, Secret: "s3cr3t", Lease: time.Minute}
+	if err := zr.OnStartup(); err == nil {
+		t.Fatalf("Expected an error when the address is in use")
+	}
+	if zr.cancel != nil {
+		t.Errorf("Expected no background task to be started")
+	}
+}
@@ -0,0 +1,148 @@
+package zoneregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// resolveIntervalDefault is how often the hosts of the peers are resolved.
+	resolveIntervalDefault = 30 * time.Second
+	// resolveTimeout is the deadline of each query sent to a resolver.
+	resolveTimeout = 5 * time.Second
+)
+
+// resolvePeers resolves the hosts of the peers without configured addresses,
+// at most MaxConcurrentChecks at a time.
+func (zr *ZoneRegistry) resolvePeers(ctx context.Context) {
+	if zr.upstream == "" {
+		return
+	}
+	zr.mu.RLock()
+	peers := append([]*Peer(nil), zr.Peers...)
+	zr.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(zr.MaxConcurrentChecks, 1))
+	for _, p := range peers {
+		if !p.needsResolution() {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			zr.resolvePeer(ctx, p)
+		}()
+	}
+	wg.Wait()
+}
+
+// resolvePeer resolves the host of p. On failure, p keeps its previous addresses.
+func (zr *ZoneRegistry) resolvePeer(ctx context.Context, p *Peer) {
+	if zr.upstream == "" {
+		return
+	}
+	addrs, err := resolveHost(ctx, zr.upstream, p.Host)
+	if err != nil {
+		log.Warningf("Failed to resolve %s, keeping its previous addresses: %v", p.Host, err)
+		return
+	}
+	if prev := p.resolved.Swap(addrs); prev == nil || !prev.equal(addrs) {
+		log.Infof("Peer %s resolved to %v %v", p.Host, addrs.IPv4, addrs.IPv6)
+	}
+}
+
+// watchResolution resolves the hosts of the peers every ResolveInterval until
+// ctx is cancelled.
+func (zr *ZoneRegistry) watchResolution(ctx context.Context) {
+	ticker := time.NewTicker(zr.ResolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		zr.resolvePeers(ctx)
+	}
+}
+
+// resolveHost returns the addresses of host, following CNAMEs through the
+// server's answer. A host that doesn't exist has no addresses.
+func resolveHost(ctx context.Context, server, host string) (*resolvedAddrs, error) {
+	addrs := &resolvedAddrs{}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := exchange(ctx, server, host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("unexpected rcode %s for %s", dns.RcodeToString[resp.Rcode], host)
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs.IPv4 = append(addrs.IPv4, rr.A)
+			case *dns.AAAA:
+				addrs.IPv6 = append(addrs.IPv6, rr.AAAA)
+			}
+		}
+	}
+
+	compare := func(a, b net.IP) int { return slices.Compare(a.To16(), b.To16()) }
+	slices.SortFunc(addrs.IPv4, compare)
+	slices.SortFunc(addrs.IPv6, compare)
+	return addrs, nil
+}
+
+// equal reports whether r and o hold the same addresses.
+func (r *resolvedAddrs) equal(o *resolvedAddrs) bool {
+	eq := func(a, b net.IP) bool { return a.Equal(b) }
+	return slices.EqualFunc(r.IPv4, o.IPv4, eq) && slices.EqualFunc(r.IPv6, o.IPv6, eq)
+}
+
+// exchange sends a query for name and qtype to server, retrying over TCP if
+// the answer is truncated.
+func exchange(ctx context.Context, server, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+
+	client := &dns.Client{Timeout: resolveTimeout}
+	resp, _, err := client.ExchangeContext(ctx, m, server)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, m, server)
+	}
+	return resp, err
+}
+
+// defaultResolver returns the first nameserver of the system's resolver configuration.
+func defaultResolver() (string, error) {
+	cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	if len(cfg.Servers) == 0 {
+		return "", errors.New("no nameserver in /etc/resolv.conf")
+	}
+	return net.JoinHostPort(cfg.Servers[0], cfg.Port), nil
+}
+
+// resolverAddr returns addr with the DNS port if it has none.
+func resolverAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(int(dnsPortDefault)))
+}
@@ -0,0 +1,133 @@
+package zoneregistry
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestResolveHost(t *testing.T) {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		q := r.Question[0]
+		switch {
+		case q.Name == "peer1.example.org." && q.Qtype == dns.TypeA:
+			ret.Answer = []dns.RR{
+				test.A("peer1.example.org. 30 IN A 10.0.0.2"),
+				test.A("peer1.example.org. 30 IN A 10.0.0.1"),
+			}
+		case q.Name == "peer1.example.org." && q.Qtype == dns.TypeAAAA:
+			ret.Answer = []dns.RR{test.AAAA("peer1.example.org. 30 IN AAAA 2001:db8::1")}
+		case q.Name == "peer2.example.org." && q.Qtype == dns.TypeA:
+			ret.Answer = []dns.RR{
+				test.CNAME("peer2.example.org. 30 IN CNAME ingress.example.net."),
+				test.A("ingress.example.net. 30 IN A 10.0.0.3"),
+			}
+		case q.Name == "broken.example.org.":
+			ret.Rcode = dns.RcodeServerFailure
+		case q.Name == "missing.example.org.":
+			ret.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tests := []struct {
+		host         string
+		shouldErr    bool
+		expectedIPv4 []string
+		expectedIPv6 []string
+	}{
+		{host: "peer1.example.org.", expectedIPv4: []string{"10.0.0.1", "10.0.0.2"}, expectedIPv6: []string{"2001:db8::1"}},
+		{host: "peer2.example.org.", expectedIPv4: []string{"10.0.0.3"}},
+		{host: "missing.example.org."},
+		{host: "broken.example.org.", shouldErr: true},
+	}
+
+	for i, tc := range tests {
+		addrs, err := resolveHost(context.TODO(), s.Addr, tc.host)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		check := func(family string, ips []net.IP, expected []string) {
+			if len(ips) != len(expected) {
+				t.Errorf("Test %d: Expected %s addresses %v, got %v", i, family, expected, ips)
+				return
+			}
+			for j, ip := range expected {
+				if ips[j].String() != ip {
+					t.Errorf("Test %d: Expected %s address %s, got %s", i, family, ip, ips[j])
+				}
+			}
+		}
+		check(familyIPv4, addrs.IPv4, tc.expectedIPv4)
+		check(familyIPv6, addrs.IPv6, tc.expectedIPv6)
+	}
+
+	// A failed resolution keeps the previous addresses
+	zr := newZoneRegistry()
+	zr.upstream = s.Addr
+	peer := NewPeer()
+	peer.Host = "peer1.example.org."
+	zr.resolvePeer(context.TODO(), peer)
+	peer.Host = "broken.example.org."
+	zr.resolvePeer(context.TODO(), peer)
+	if len(peer.addrs(familyIPv4)) != 2 || len(peer.addrs(familyIPv6)) != 1 {
+		t.Errorf("Expected the peer to keep its addresses, got %v %v", peer.addrs(familyIPv4), peer.addrs(familyIPv6))
+	}
+}
+
+func TestResolutionOnStartup(t *testing.T) {
+	// The upstream is slow to answer, the startup must not wait for it
+	port := newPeerServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(300 * time.Millisecond)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			ret.Answer = []dns.RR{test.A("peer1.example.org. 30 IN A 127.0.0.1")}
+		}
+		w.WriteMsg(ret)
+	})
+
+	zr := newZoneRegistry()
+	zr.Timeout = 1
+	zr.Upstream = net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	peer := NewPeer()
+	peer.Host = "peer1.example.org."
+	peer.Port = 1
+	zr.Peers = []*Peer{peer}
+
+	start := time.Now()
+	if err := zr.OnStartup(); err != nil {
+		t.Fatalf("Expected no error on startup, got %v", err)
+	}
+	defer zr.OnShutdown()
+	if time.Since(start) > 200*time.Millisecond {
+		t.Errorf("Expected the startup not to wait for the resolution, took %s", time.Since(start))
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for !zr.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the registry to be ready after the first resolution")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addrs := peer.addrs(familyIPv4); len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected the peer to be resolved before being ready, got %v", addrs)
+	}
+}
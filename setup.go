@@ -1,13 +1,23 @@
 package zoneregistry
 
 import (
+	"crypto/tls"
+	"encoding/base64"
+	"math"
 	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	ctls "github.com/coredns/coredns/plugin/pkg/tls"
 )
 
 const pluginName = "zoneregistry"
@@ -24,7 +34,33 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return plugin.Error(pluginName, err)
 	}
-	go zr.StartHealthChecks()
+	zr.publishHealth()
+	if len(zr.Nameservers) == 0 {
+		log.Warningf("No ns configured for %v, the default ns1 nameserver of each zone has no address", zr.Zones)
+	}
+
+	c.OnStartup(zr.OnStartup)
+	c.OnShutdown(zr.OnShutdown)
+	// The new instance starts before the old one shuts down, the registration
+	// API must release its address first
+	c.OnRestart(zr.suspendRegistration)
+	c.OnRestartFailed(zr.startRegistration)
+	c.OnRestart(zr.suspendUpdates)
+	c.OnRestartFailed(zr.resumeUpdates)
+
+	if zr.Update != nil {
+		// The server verifies the signatures of the messages with the keys
+		config := dnsserver.GetConfig(c)
+		if config.TsigSecret == nil {
+			config.TsigSecret = map[string]string{}
+		}
+		for name, secret := range zr.Update.Keys {
+			config.TsigSecret[name] = secret
+		}
+		if !updatesAccepted() {
+			log.Warningf("UPDATE messages are refused by the DNS server, the binary must call zoneregistry.AcceptUpdateMessages for update to work")
+		}
+	}
 
 	// Add the Plugin to CoreDNS, so Servers can use it in their plugin chain.
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
@@ -83,8 +119,8 @@ func parse(c *caddy.Controller) (*ZoneRegistry, error) {
 				if err != nil {
 					return nil, err
 				}
-				if t < 0 || t > 300 {
-					return nil, c.Errf("interval must be in range [0, 300]: %d", t)
+				if t < 1 || t > 300 {
+					return nil, c.Errf("interval must be in range [1, 300]: %d", t)
 				}
 				zr.Interval = uint32(t)
 
@@ -97,11 +133,197 @@ func parse(c *caddy.Controller) (*ZoneRegistry, error) {
 				if err != nil {
 					return nil, err
 				}
-				if t < 0 || t > 30 {
-					return nil, c.Errf("timeout must be in range [0, 30]: %d", t)
+				if t < 1 || t > 30 {
+					return nil, c.Errf("timeout must be in range [1, 30]: %d", t)
 				}
 				zr.Timeout = uint32(t)
 
+			case "mode":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				if args[0] != modeReferral && args[0] != modeAnswer && args[0] != modeProxy {
+					return nil, c.Errf("mode must be ['%s', '%s', '%s']: %s", modeReferral, modeAnswer, modeProxy, args[0])
+				}
+				zr.Mode = args[0]
+
+			case "lb":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				b := newBalancer(args[0])
+				if b == nil {
+					return nil, c.Errf("lb must be ['%s', '%s', '%s', '%s', '%s']: %s", lbRoundRobin, lbRandom, lbWeighted, lbFirst, lbLatency, args[0])
+				}
+				switch {
+				case len(args) == 2 && args[0] == lbLatency:
+					d, err := time.ParseDuration(args[1])
+					if err != nil {
+						return nil, err
+					}
+					if d <= 0 {
+						return nil, c.Errf("latency ceiling must be positive: %s", d)
+					}
+					b = latency{Ceiling: d}
+				case len(args) > 1:
+					return nil, c.ArgErr()
+				}
+				zr.Balancer = b
+
+			case "initial_state":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				if args[0] != initialHealthy && args[0] != initialUnhealthy && args[0] != initialUnknown {
+					return nil, c.Errf("initial_state must be ['%s', '%s', '%s']: %s", initialHealthy, initialUnhealthy, initialUnknown, args[0])
+				}
+				zr.InitialState = args[0]
+
+			case "soa":
+				if err := parseSOA(c, &zr.SOA); err != nil {
+					return nil, err
+				}
+
+			case "ns":
+				ns, err := parseNameserver(c)
+				if err != nil {
+					return nil, err
+				}
+				zr.Nameservers = append(zr.Nameservers, ns)
+
+			case "services":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, arg := range args {
+					zr.Services = append(zr.Services, strings.ToLower(strings.Trim(arg, ".")))
+				}
+
+			case "retries":
+				n, err := parseUint32(c, "retries", 0, 10)
+				if err != nil {
+					return nil, err
+				}
+				zr.Retries = n
+
+			case "retry_backoff":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil {
+					return nil, err
+				}
+				if d < 0 || d > time.Minute {
+					return nil, c.Errf("retry_backoff must be in range [0s, 1m]: %s", d)
+				}
+				zr.RetryBackoff = d
+
+			case "max_concurrent_checks":
+				n, err := parseUint32(c, "max_concurrent_checks", 1, 4096)
+				if err != nil {
+					return nil, err
+				}
+				zr.MaxConcurrentChecks = n
+
+			case "jitter":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil {
+					return nil, err
+				}
+				if d < 0 || d > 5*time.Minute {
+					return nil, c.Errf("jitter must be in range [0s, 5m]: %s", d)
+				}
+				zr.Jitter = d
+
+			case "glue":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				zr.Glue = nil
+				for _, arg := range args {
+					if arg != familyIPv4 && arg != familyIPv6 {
+						return nil, c.Errf("glue must be ['%s', '%s']: %s", familyIPv4, familyIPv6, arg)
+					}
+					if slices.Contains(zr.Glue, arg) {
+						return nil, c.Errf("duplicate glue address family: %s", arg)
+					}
+					zr.Glue = append(zr.Glue, arg)
+				}
+
+			case "peers_file":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				f := &peersFile{Path: args[0], Reload: reloadDefault}
+				if root := dnsserver.GetConfig(c).Root; !filepath.IsAbs(f.Path) && root != "" {
+					f.Path = filepath.Join(root, f.Path)
+				}
+				if len(args) == 2 {
+					d, err := time.ParseDuration(args[1])
+					if err != nil {
+						return nil, err
+					}
+					if d < 0 {
+						return nil, c.Errf("peers_file reload must be positive: %s", d)
+					}
+					f.Reload = d
+				}
+				zr.PeersFile = f
+
+			case "upstream":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				zr.Upstream = resolverAddr(args[0])
+
+			case "resolve_interval":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil {
+					return nil, err
+				}
+				if d < time.Second {
+					return nil, c.Errf("resolve_interval must be at least 1s: %s", d)
+				}
+				zr.ResolveInterval = d
+
+			case "discover":
+				d, err := parseDiscover(c)
+				if err != nil {
+					return nil, err
+				}
+				zr.Discoveries = append(zr.Discoveries, d)
+
+			case "update":
+				u, err := parseUpdate(c)
+				if err != nil {
+					return nil, err
+				}
+				zr.Update = u
+
+			case "registration":
+				r, err := parseRegistration(c)
+				if err != nil {
+					return nil, err
+				}
+				zr.Registration = r
+
 			case "peer":
 				peer, err := parsePeer(c)
 				if err != nil {
@@ -115,11 +337,22 @@ func parse(c *caddy.Controller) (*ZoneRegistry, error) {
 			}
 		}
 	}
+	if zr.Jitter > 0 && zr.Jitter >= time.Duration(zr.Interval)*time.Second {
+		return nil, c.Errf("jitter must be less than the interval: %s", zr.Jitter)
+	}
+	if zr.PeersFile != nil {
+		peers, _, err := zr.PeersFile.load()
+		if err != nil {
+			return nil, c.Errf("failed to load %s: %v", zr.PeersFile.Path, err)
+		}
+		zr.setPeers(sourceFile, peers)
+	}
 	return zr, nil
 }
 
 func parsePeer(c *caddy.Controller) (*Peer, error) {
 	peer := NewPeer()
+	composite := &compositeCheck{Policy: policyAll}
 
 	args := c.RemainingArgs()
 	if len(args) == 0 {
@@ -129,6 +362,7 @@ func parsePeer(c *caddy.Controller) (*Peer, error) {
 		peer.Host = h[0]
 	}
 
+peerBlock:
 	for c.Next() {
 		switch c.Val() {
 
@@ -145,6 +379,13 @@ func parsePeer(c *caddy.Controller) (*Peer, error) {
 		case "labels":
 			peer.Labels = c.RemainingArgs()
 
+		case "weight":
+			w, err := parseUint32(c, "weight", 0, 65535)
+			if err != nil {
+				return nil, err
+			}
+			peer.Weight = w
+
 		case "ipv4":
 			args := c.RemainingArgs()
 			if len(args) == 0 {
@@ -198,17 +439,658 @@ func parsePeer(c *caddy.Controller) (*Peer, error) {
 			}
 			peer.Port = uint32(p)
 
+		case "dns_port":
+			p, err := parseUint32(c, "dns_port", 0, 65535)
+			if err != nil {
+				return nil, err
+			}
+			peer.DNSPort = p
+
+		case "rise":
+			n, err := parseUint32(c, "rise", 1, 100)
+			if err != nil {
+				return nil, err
+			}
+			peer.Rise = n
+
+		case "fall":
+			n, err := parseUint32(c, "fall", 1, 100)
+			if err != nil {
+				return nil, err
+			}
+			peer.Fall = n
+
+		case "hold":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			d, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if d < 0 {
+				return nil, c.Errf("hold must be positive: %s", d)
+			}
+			peer.Hold = d
+
+		case "dampening":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			base, err := time.ParseDuration(args[0])
+			if err != nil {
+				return nil, err
+			}
+			max, err := time.ParseDuration(args[1])
+			if err != nil {
+				return nil, err
+			}
+			if base <= 0 || max < base {
+				return nil, c.Errf("dampening must satisfy 0 < BASE <= MAX: %s %s", base, max)
+			}
+			peer.DampeningBase, peer.DampeningMax = base, max
+
+		case "retries":
+			n, err := parseUint32(c, "retries", 0, 10)
+			if err != nil {
+				return nil, err
+			}
+			peer.Retries = &n
+
+		case "tls":
+			cfg, err := parseTLS(c)
+			if err != nil {
+				return nil, err
+			}
+			peer.TLS = cfg
+
+		case "check":
+			name, check, err := parseCheck(c)
+			if err != nil {
+				return nil, err
+			}
+			if e, ok := check.(*execCheck); ok && e.Command == "" {
+				return nil, c.Errf("%s checks require a command", checkExec)
+			}
+			for _, nc := range composite.Checks {
+				if nc.Name == name {
+					return nil, c.Errf("duplicate check name %s, checks of the same type must be named", name)
+				}
+			}
+			composite.Checks = append(composite.Checks, namedCheck{Name: name, Check: check})
+
+		case "checks":
+			args := c.RemainingArgs()
+			switch {
+			case len(args) == 1 && (args[0] == policyAll || args[0] == policyAny):
+				composite.Policy = args[0]
+			case len(args) == 2 && args[0] == policyQuorum:
+				n, err := strconv.Atoi(args[1])
+				if err != nil {
+					return nil, err
+				}
+				if n < 1 {
+					return nil, c.Errf("quorum must be positive: %d", n)
+				}
+				composite.Policy, composite.Quorum = policyQuorum, n
+			default:
+				return nil, c.Errf("checks must be ['%s', '%s', '%s N']: %s", policyAll, policyAny, policyQuorum, strings.Join(args, " "))
+			}
+
 		// Must manually check for blocks since c.NextBlock doesn't support nesting
 		case "{":
 			// Opening the peer block
 			continue
 		case "}":
 			// Closing the peer block
-			return peer, nil
+			break peerBlock
 
 		default:
 			return nil, c.Errf("Unknown property '%s'", c.Val())
 		}
 	}
+
+	if composite.Policy == policyQuorum && composite.Quorum > len(composite.Checks) {
+		return nil, c.Errf("quorum %d exceeds the %d checks of peer %s", composite.Quorum, len(composite.Checks), peer.Host)
+	}
+	peer.Check = composite.peerCheck()
 	return peer, nil
 }
+
+func parseSOA(c *caddy.Controller, soa *SOA) error {
+	args := c.RemainingArgs()
+	if len(args) > 2 {
+		return c.ArgErr()
+	}
+	if len(args) > 0 {
+		soa.Mname = plugin.Name(args[0]).Normalize()
+	}
+	if len(args) > 1 {
+		soa.Rname = plugin.Name(args[1]).Normalize()
+	}
+	// The block is optional, it must open on the same line
+	if !c.NextArg() {
+		return nil
+	}
+
+	for c.Next() {
+		switch c.Val() {
+
+		case "mname":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return c.ArgErr()
+			}
+			soa.Mname = plugin.Name(args[0]).Normalize()
+
+		case "rname":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return c.ArgErr()
+			}
+			soa.Rname = plugin.Name(args[0]).Normalize()
+
+		case "serial":
+			v, err := parseUint32(c, "serial", 0, math.MaxUint32)
+			if err != nil {
+				return err
+			}
+			soa.Serial = v
+
+		case "refresh":
+			v, err := parseUint32(c, "refresh", 0, math.MaxInt32)
+			if err != nil {
+				return err
+			}
+			soa.Refresh = v
+
+		case "retry":
+			v, err := parseUint32(c, "retry", 0, math.MaxInt32)
+			if err != nil {
+				return err
+			}
+			soa.Retry = v
+
+		case "expire":
+			v, err := parseUint32(c, "expire", 0, math.MaxInt32)
+			if err != nil {
+				return err
+			}
+			soa.Expire = v
+
+		case "minimum":
+			v, err := parseUint32(c, "minimum", 0, 86400)
+			if err != nil {
+				return err
+			}
+			soa.Minimum = v
+
+		// Must manually check for blocks since c.NextBlock doesn't support nesting
+		case "}":
+			return nil
+
+		default:
+			return c.Errf("Unknown property '%s'", c.Val())
+		}
+	}
+	return nil
+}
+
+func parseNameserver(c *caddy.Controller) (*Nameserver, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	ns := &Nameserver{Host: plugin.Name(args[0]).Normalize()}
+
+	for _, arg := range args[1:] {
+		ip := net.ParseIP(arg)
+		switch {
+		case ip == nil:
+			return nil, c.Errf("invalid nameserver address: %s", arg)
+		case ip.To4() != nil:
+			ns.IPv4 = ip
+		default:
+			ns.IPv6 = ip
+		}
+	}
+	return ns, nil
+}
+
+// parseUint32 parses the single argument of property name and checks that it
+// is in range [min, max].
+func parseUint32(c *caddy.Controller, name string, min, max uint64) (uint32, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return 0, c.ArgErr()
+	}
+	v, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if v < min || v > max {
+		return 0, c.Errf("%s must be in range [%d, %d]: %d", name, min, max, v)
+	}
+	return uint32(v), nil
+}
+
+// parseCheck parses a check and its optional name, which defaults to the type
+// of the check.
+func parseCheck(c *caddy.Controller) (string, HealthChecker, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return "", nil, c.ArgErr()
+	}
+	check := newHealthChecker(args[0])
+	if check == nil {
+		return "", nil, c.Errf("check must be ['%s', '%s', '%s', '%s', '%s']: %s", checkHTTP, checkTCP, checkDNS, checkGRPC, checkExec, args[0])
+	}
+	name := args[0]
+	if len(args) == 2 {
+		name = args[1]
+	}
+	// The block is optional, it must open on the same line
+	if !c.NextArg() {
+		return name, check, nil
+	}
+
+	for c.Next() {
+		switch c.Val() {
+
+		case "port":
+			p, err := parseUint32(c, "port", 0, 65535)
+			if err != nil {
+				return "", nil, err
+			}
+			switch check := check.(type) {
+			case *httpCheck:
+				check.Port = p
+			case *tcpCheck:
+				check.Port = p
+			case *dnsCheck:
+				check.Port = p
+			case *grpcCheck:
+				check.Port = p
+			default:
+				return "", nil, c.Errf("port is not supported by %s checks", args[0])
+			}
+
+		case "protocol", "path", "method", "host", "header", "body", "status", "expect_body", "expect_json", "expect_header", reportCapacity, reportLoad:
+			h, ok := check.(*httpCheck)
+			if !ok {
+				return "", nil, c.Errf("%s is only supported by %s checks", c.Val(), checkHTTP)
+			}
+			if err := parseHTTPCheckOption(c, h); err != nil {
+				return "", nil, err
+			}
+
+		case "transport":
+			d, ok := check.(*dnsCheck)
+			if !ok {
+				return "", nil, c.Errf("transport is only supported by %s checks", checkDNS)
+			}
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return "", nil, c.ArgErr()
+			}
+			if args[0] != "udp" && args[0] != "tcp" {
+				return "", nil, c.Errf("transport must be ['udp', 'tcp']: %s", args[0])
+			}
+			d.Transport = args[0]
+
+		case "service":
+			g, ok := check.(*grpcCheck)
+			if !ok {
+				return "", nil, c.Errf("service is only supported by %s checks", checkGRPC)
+			}
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return "", nil, c.ArgErr()
+			}
+			g.Service = args[0]
+
+		case "command":
+			e, ok := check.(*execCheck)
+			if !ok {
+				return "", nil, c.Errf("command is only supported by %s checks", checkExec)
+			}
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return "", nil, c.ArgErr()
+			}
+			e.Command, e.Args = args[0], args[1:]
+
+		// Must manually check for blocks since c.NextBlock doesn't support nesting
+		case "}":
+			return name, check, nil
+
+		default:
+			return "", nil, c.Errf("Unknown property '%s'", c.Val())
+		}
+	}
+	return name, check, nil
+}
+
+// parseHTTPCheckOption parses the current property of an HTTP check block into h.
+func parseHTTPCheckOption(c *caddy.Controller, h *httpCheck) error {
+	prop := c.Val()
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+
+	switch prop {
+	case "protocol":
+		if args[0] != "http" && args[0] != "https" {
+			return c.Errf("protocol must be ['http', 'https']: %s", args[0])
+		}
+		h.Protocol = args[0]
+
+	case "path":
+		h.Path = args[0]
+
+	case "method":
+		h.Method = strings.ToUpper(args[0])
+
+	case "host":
+		h.Host = args[0]
+
+	case "header":
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		if h.Headers == nil {
+			h.Headers = http.Header{}
+		}
+		h.Headers.Add(args[0], args[1])
+
+	case "body":
+		h.Body = args[0]
+
+	case "status":
+		for _, arg := range args {
+			r, err := parseStatusRange(arg)
+			if err != nil {
+				return c.Errf("invalid status %s: %v", arg, err)
+			}
+			h.Status = append(h.Status, r)
+		}
+
+	case "expect_body":
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return err
+		}
+		h.ExpectBody = re
+
+	case "expect_json":
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		h.ExpectJSON = append(h.ExpectJSON, jsonAssertion{Path: args[0], Value: args[1]})
+
+	case "expect_header":
+		if len(args) > 2 {
+			return c.ArgErr()
+		}
+		a := headerAssertion{Name: args[0]}
+		if len(args) == 2 {
+			re, err := regexp.Compile(args[1])
+			if err != nil {
+				return err
+			}
+			a.Value = re
+		}
+		h.ExpectHeaders = append(h.ExpectHeaders, a)
+
+	case reportCapacity, reportLoad:
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		r := &loadReport{Kind: prop}
+		switch args[0] {
+		case "json":
+			r.Path = args[1]
+		case "header":
+			r.Header = args[1]
+		default:
+			return c.Errf("%s source must be ['json', 'header']: %s", prop, args[0])
+		}
+		h.Report = r
+	}
+	return nil
+}
+
+func parseRegistration(c *caddy.Controller) (*registration, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return nil, c.ArgErr()
+	}
+	r := &registration{Addr: args[0], Lease: leaseDefault}
+	if _, _, err := net.SplitHostPort(r.Addr); err != nil {
+		return nil, c.Errf("invalid registration address: %v", err)
+	}
+
+	// The block is optional, it must open on the same line
+	if c.NextArg() {
+	block:
+		for c.Next() {
+			switch c.Val() {
+
+			case authSecret, authHMAC:
+				auth := c.Val()
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				if r.Auth != "" {
+					return nil, c.Errf("registration takes a single secret or hmac key")
+				}
+				r.Auth, r.Secret = auth, args[0]
+
+			case "lease":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil {
+					return nil, err
+				}
+				if d < time.Second {
+					return nil, c.Errf("lease must be at least 1s: %s", d)
+				}
+				r.Lease = d
+
+			// Must manually check for blocks since c.NextBlock doesn't support nesting
+			case "}":
+				break block
+
+			default:
+				return nil, c.Errf("Unknown property '%s'", c.Val())
+			}
+		}
+	}
+
+	if r.Secret == "" {
+		return nil, c.Errf("registration requires a secret or an hmac key")
+	}
+	return r, nil
+}
+
+func parseUpdate(c *caddy.Controller) (*dynamicUpdate, error) {
+	if len(c.RemainingArgs()) != 0 {
+		return nil, c.ArgErr()
+	}
+	u := &dynamicUpdate{Keys: map[string]string{}}
+
+	// The block is optional, it must open on the same line
+	if c.NextArg() {
+	block:
+		for c.Next() {
+			switch c.Val() {
+
+			case "key":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				name := plugin.Name(args[0]).Normalize()
+				if _, ok := u.Keys[name]; ok {
+					return nil, c.Errf("key %s redefined", name)
+				}
+				if _, err := base64.StdEncoding.DecodeString(args[1]); err != nil {
+					return nil, c.Errf("invalid secret of key %s: %v", name, err)
+				}
+				u.Keys[name] = args[1]
+
+			// Must manually check for blocks since c.NextBlock doesn't support nesting
+			case "}":
+				break block
+
+			default:
+				return nil, c.Errf("Unknown property '%s'", c.Val())
+			}
+		}
+	}
+
+	if len(u.Keys) == 0 {
+		return nil, c.Errf("update requires at least one key")
+	}
+	return u, nil
+}
+
+func parseDiscover(c *caddy.Controller) (*srvDiscovery, error) {
+	args := c.RemainingArgs()
+	if len(args) != 2 {
+		return nil, c.ArgErr()
+	}
+	if args[0] != discoverSRV {
+		return nil, c.Errf("discover must be ['%s']: %s", discoverSRV, args[0])
+	}
+	d := &srvDiscovery{Name: plugin.Name(args[1]).Normalize(), Refresh: discoverRefreshDefault}
+
+	// The block is optional, it must open on the same line
+	if c.NextArg() {
+	block:
+		for c.Next() {
+			switch c.Val() {
+
+			case "resolver":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				d.Resolver = resolverAddr(args[0])
+
+			case "refresh":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				r, err := time.ParseDuration(args[0])
+				if err != nil {
+					return nil, err
+				}
+				if r < time.Second {
+					return nil, c.Errf("refresh must be at least 1s: %s", r)
+				}
+				d.Refresh = r
+
+			// Must manually check for blocks since c.NextBlock doesn't support nesting
+			case "}":
+				break block
+
+			default:
+				return nil, c.Errf("Unknown property '%s'", c.Val())
+			}
+		}
+	}
+
+	if d.Resolver == "" {
+		r, err := defaultResolver()
+		if err != nil {
+			return nil, c.Errf("no resolver to discover %s, set one with resolver: %v", d.Name, err)
+		}
+		d.Resolver = r
+	}
+	return d, nil
+}
+
+func parseTLS(c *caddy.Controller) (*tls.Config, error) {
+	var ca, cert, key, serverName string
+	insecure := false
+
+	if len(c.RemainingArgs()) != 0 {
+		return nil, c.ArgErr()
+	}
+	// The block is optional, it must open on the same line
+	if c.NextArg() {
+	block:
+		for c.Next() {
+			switch c.Val() {
+
+			case "ca":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				ca = args[0]
+
+			case "cert":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				cert, key = args[0], args[1]
+
+			case "server_name":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				serverName = args[0]
+
+			case "insecure_skip_verify":
+				if len(c.RemainingArgs()) != 0 {
+					return nil, c.ArgErr()
+				}
+				insecure = true
+
+			// Must manually check for blocks since c.NextBlock doesn't support nesting
+			case "}":
+				break block
+
+			default:
+				return nil, c.Errf("Unknown property '%s'", c.Val())
+			}
+		}
+	}
+
+	cfg, err := newTLSConfig(ca, cert, key, serverName, insecure)
+	if err != nil {
+		return nil, c.Err(err.Error())
+	}
+	return cfg, nil
+}
+
+// newTLSConfig returns the client TLS configuration of a peer verifying its
+// certificate with the ca bundle, the system's if empty, and presenting the
+// cert and key if set.
+func newTLSConfig(ca, cert, key, serverName string, insecure bool) (*tls.Config, error) {
+	var cfg *tls.Config
+	var err error
+	if cert != "" {
+		cfg, err = ctls.NewTLSConfig(cert, key, ca)
+	} else {
+		cfg, err = ctls.NewTLSClientConfig(ca)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg.ServerName = serverName
+	cfg.InsecureSkipVerify = insecure
+	return cfg, nil
+}
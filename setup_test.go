@@ -2,7 +2,9 @@ package zoneregistry
 
 import (
 	"net"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/plugin/pkg/fall"
@@ -17,6 +19,7 @@ func TestParse(t *testing.T) {
 		expectedTTL         uint32
 		expectedInterval    uint32
 		expectedTimeout     uint32
+		expectedMode        string
 		expectedFallthrough *fall.F
 	}{
 		// Validation tests
@@ -78,7 +81,138 @@ func TestParse(t *testing.T) {
 			expectedTimeout:     timeoutDefault,
 			expectedFallthrough: &fall.F{Zones: []string{"example.com.", "."}},
 		},
+		{
+			input: `zoneregistry example.org {
+						mode answer
+					}`,
+			shouldErr:           false,
+			expectedZone:        "example.org.",
+			expectedZones:       1,
+			expectedTTL:         ttlDefault,
+			expectedInterval:    intervalDefault,
+			expectedTimeout:     timeoutDefault,
+			expectedMode:        modeAnswer,
+			expectedFallthrough: nil,
+		},
 		// Error tests
+		{
+			input: `zoneregistry example.org {
+						mode asdf
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						lb asdf
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						lb round_robin 100ms
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						lb latency 0s
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						glue ipv4 ipv4
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						max_concurrent_checks 0
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						peers_file /nonexistent/peers.yaml
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						discover a _zoneregistry._tcp.example.org
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						resolve_interval 0s
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						discover srv _zoneregistry._tcp.example.org {
+							refresh 10ms
+						}
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						interval 10
+						jitter 10s
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						registration 127.0.0.1:8053
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						registration 127.0.0.1:8053 {
+							secret s3cr3t
+							hmac s3cr3t
+						}
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						update
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						update {
+							key update.example.org. not-base64!
+						}
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						registration localhost {
+							secret s3cr3t
+						}
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						interval 0
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						timeout 0
+					}`,
+			shouldErr: true,
+		},
 		{
 			input: `zoneregistry example.org {
 						ttl string_not_uint32
@@ -126,6 +260,10 @@ func TestParse(t *testing.T) {
 		if !test.shouldErr && zr.Timeout != test.expectedTimeout {
 			t.Errorf("Test %d, expected TIMEOUT %d, got: %d", i, test.expectedTimeout, zr.Timeout)
 		}
+		// Validate Mode
+		if !test.shouldErr && test.expectedMode != "" && zr.Mode != test.expectedMode {
+			t.Errorf("Test %d, expected MODE %s, got: %s", i, test.expectedMode, zr.Mode)
+		}
 		// Validate Fallthrough
 		if test.expectedFallthrough != nil && !test.shouldErr {
 			if len(test.expectedFallthrough.Zones) != len(zr.Fall.Zones) {
@@ -140,6 +278,83 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParseLB(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedBalancer Balancer
+	}{
+		{input: `zoneregistry example.org`, expectedBalancer: &roundRobin{}},
+		{input: `zoneregistry example.org {
+					lb latency
+				}`, expectedBalancer: latency{}},
+		{input: `zoneregistry example.org {
+					lb latency 150ms
+				}`, expectedBalancer: latency{Ceiling: 150 * time.Millisecond}},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		zr, err := parse(c)
+		if err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if !reflect.DeepEqual(zr.Balancer, test.expectedBalancer) {
+			t.Errorf("Test %d: Expected balancer %#v, got %#v", i, test.expectedBalancer, zr.Balancer)
+		}
+	}
+}
+
+func TestParseDiscover(t *testing.T) {
+	c := caddy.NewTestController("dns", `zoneregistry example.org {
+		discover srv _zoneregistry._tcp.example.org {
+			resolver 10.0.0.53
+			refresh 1m
+		}
+	}`)
+	zr, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []*srvDiscovery{{Name: "_zoneregistry._tcp.example.org.", Resolver: "10.0.0.53:53", Refresh: time.Minute}}
+	if !reflect.DeepEqual(zr.Discoveries, expected) {
+		t.Errorf("Expected discoveries %+v, got %+v", expected, zr.Discoveries)
+	}
+}
+
+func TestParseRegistration(t *testing.T) {
+	c := caddy.NewTestController("dns", `zoneregistry example.org {
+		registration :8053 {
+			hmac s3cr3t
+			lease 5m
+		}
+	}`)
+	zr, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := &registration{Addr: ":8053", Auth: authHMAC, Secret: "s3cr3t", Lease: 5 * time.Minute}
+	if !reflect.DeepEqual(zr.Registration, expected) {
+		t.Errorf("Expected registration %+v, got %+v", expected, zr.Registration)
+	}
+}
+
+func TestParseUpdate(t *testing.T) {
+	c := caddy.NewTestController("dns", `zoneregistry example.org {
+		update {
+			key Update.Example.org c2VjcmV0
+			key other.example.org. b3RoZXI=
+		}
+	}`)
+	zr, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := map[string]string{"update.example.org.": "c2VjcmV0", "other.example.org.": "b3RoZXI="}
+	if !reflect.DeepEqual(zr.Update.Keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, zr.Update.Keys)
+	}
+}
+
 func TestParsePeer(t *testing.T) {
 	tests := []struct {
 		input            string
@@ -181,6 +396,12 @@ func TestParsePeer(t *testing.T) {
 					}`,
 			shouldErr: true,
 		},
+		{
+			input: `peer peer1 {
+						weight 70000
+					}`,
+			shouldErr: true,
+		},
 	}
 	for i, test := range tests {
 		c := caddy.NewTestController("dns", test.input)
@@ -224,3 +445,346 @@ func TestParsePeer(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSOA(t *testing.T) {
+	tests := []struct {
+		input               string
+		shouldErr           bool
+		expectedMname       string
+		expectedRname       string
+		expectedRefresh     uint32
+		expectedMinimum     uint32
+		expectedNameservers int
+	}{
+		{
+			input:           `zoneregistry example.org`,
+			shouldErr:       false,
+			expectedRefresh: refreshDefault,
+			expectedMinimum: minimumDefault,
+		},
+		{
+			input: `zoneregistry example.org {
+						soa ns.example.org admin.example.org
+						ttl 60
+					}`,
+			shouldErr:       false,
+			expectedMname:   "ns.example.org.",
+			expectedRname:   "admin.example.org.",
+			expectedRefresh: refreshDefault,
+			expectedMinimum: minimumDefault,
+		},
+		{
+			input: `zoneregistry example.org {
+						soa {
+							mname ns.example.org
+							refresh 3600
+							minimum 10
+						}
+						ns ns.example.org 10.0.0.53 2001:db8::53
+						ns ns2.example.org
+					}`,
+			shouldErr:           false,
+			expectedMname:       "ns.example.org.",
+			expectedRefresh:     3600,
+			expectedMinimum:     10,
+			expectedNameservers: 2,
+		},
+		// Error tests
+		{
+			input: `zoneregistry example.org {
+						soa {
+							minimum 100000
+						}
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `zoneregistry example.org {
+						ns ns.example.org not_an_ip
+					}`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		zr, err := parse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error but found %s for input %s", i, err, test.input)
+		}
+
+		if err != nil && !test.shouldErr {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+		}
+		if test.shouldErr {
+			continue
+		}
+		if zr.SOA.Mname != test.expectedMname {
+			t.Errorf("Test %d, expected mname %q, got: %q", i, test.expectedMname, zr.SOA.Mname)
+		}
+		if zr.SOA.Rname != test.expectedRname {
+			t.Errorf("Test %d, expected rname %q, got: %q", i, test.expectedRname, zr.SOA.Rname)
+		}
+		if zr.SOA.Refresh != test.expectedRefresh {
+			t.Errorf("Test %d, expected refresh %d, got: %d", i, test.expectedRefresh, zr.SOA.Refresh)
+		}
+		if zr.SOA.Minimum != test.expectedMinimum {
+			t.Errorf("Test %d, expected minimum %d, got: %d", i, test.expectedMinimum, zr.SOA.Minimum)
+		}
+		if len(zr.Nameservers) != test.expectedNameservers {
+			t.Errorf("Test %d, expected %d nameservers, got: %d", i, test.expectedNameservers, len(zr.Nameservers))
+		}
+	}
+}
+
+func TestParseCheck(t *testing.T) {
+	tests := []struct {
+		input         string
+		shouldErr     bool
+		expectedCheck HealthChecker
+	}{
+		{
+			input:         `peer peer1`,
+			shouldErr:     false,
+			expectedCheck: nil,
+		},
+		{
+			input: `peer peer1 {
+						check tcp
+					}`,
+			shouldErr:     false,
+			expectedCheck: &tcpCheck{},
+		},
+		{
+			input: `peer peer1 {
+						check http {
+							protocol https
+							path /ready
+							port 8443
+						}
+						role secondary
+					}`,
+			shouldErr:     false,
+			expectedCheck: &httpCheck{Protocol: "https", Path: "/ready", Port: 8443},
+		},
+		{
+			input: `peer peer1 {
+						check dns {
+							transport tcp
+						}
+					}`,
+			shouldErr:     false,
+			expectedCheck: &dnsCheck{Transport: "tcp"},
+		},
+		{
+			input: `peer peer1 {
+						check grpc {
+							port 9090
+							service ready
+						}
+					}`,
+			shouldErr:     false,
+			expectedCheck: &grpcCheck{Port: 9090, Service: "ready"},
+		},
+		{
+			input: `peer peer1 {
+						check http {
+							capacity json status.capacity
+						}
+					}`,
+			shouldErr:     false,
+			expectedCheck: &httpCheck{Report: &loadReport{Kind: reportCapacity, Path: "status.capacity"}},
+		},
+		{
+			input: `peer peer1 {
+						check http {
+							load header X-Load
+						}
+					}`,
+			shouldErr:     false,
+			expectedCheck: &httpCheck{Report: &loadReport{Kind: reportLoad, Header: "X-Load"}},
+		},
+		{
+			input: `peer peer1 {
+						check http ingress {
+							port 443
+						}
+						check dns
+					}`,
+			shouldErr: false,
+			expectedCheck: &compositeCheck{
+				Checks: []namedCheck{{Name: "ingress", Check: &httpCheck{Port: 443}}, {Name: "dns", Check: &dnsCheck{}}},
+				Policy: policyAll,
+			},
+		},
+		{
+			input: `peer peer1 {
+						checks quorum 2
+						check tcp
+						check http ingress
+						check http api
+					}`,
+			shouldErr: false,
+			expectedCheck: &compositeCheck{
+				Checks: []namedCheck{{Name: "tcp", Check: &tcpCheck{}}, {Name: "ingress", Check: &httpCheck{}}, {Name: "api", Check: &httpCheck{}}},
+				Policy: policyQuorum,
+				Quorum: 2,
+			},
+		},
+		{
+			input: `peer peer1 {
+						check exec {
+							command /usr/local/bin/check-replication --max-lag 30
+						}
+					}`,
+			shouldErr:     false,
+			expectedCheck: &execCheck{Command: "/usr/local/bin/check-replication", Args: []string{"--max-lag", "30"}},
+		},
+		// Error tests
+		{
+			input: `peer peer1 {
+						check exec
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `peer peer1 {
+						check exec {
+							port 80
+						}
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `peer peer1 {
+						check asdf
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `peer peer1 {
+						check tcp {
+							path /health
+						}
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `peer peer1 {
+						check http {
+							load body X-Load
+						}
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `peer peer1 {
+						check http
+						check http
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `peer peer1 {
+						checks quorum 3
+						check tcp
+						check dns
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `peer peer1 {
+						checks most
+					}`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		c.Next()
+		p, err := parsePeer(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error but found %s for input %s", i, err, test.input)
+		}
+		if err != nil && !test.shouldErr {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+		}
+		if !test.shouldErr && !reflect.DeepEqual(p.Check, test.expectedCheck) {
+			t.Errorf("Test %d, expected check %#v, got: %#v", i, test.expectedCheck, p.Check)
+		}
+	}
+}
+
+func TestParseTLS(t *testing.T) {
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedServerName string
+		expectedInsecure   bool
+	}{
+		{
+			input: `peer peer1 {
+						tls
+					}`,
+			shouldErr: false,
+		},
+		{
+			input: `peer peer1 {
+						tls {
+							server_name peer1.example.org
+							insecure_skip_verify
+						}
+						protocol https
+					}`,
+			shouldErr:          false,
+			expectedServerName: "peer1.example.org",
+			expectedInsecure:   true,
+		},
+		// Error tests
+		{
+			input: `peer peer1 {
+						tls {
+							ca /does/not/exist.pem
+						}
+					}`,
+			shouldErr: true,
+		},
+		{
+			input: `peer peer1 {
+						tls {
+							cert only_cert.pem
+						}
+					}`,
+			shouldErr: true,
+		},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		c.Next()
+		p, err := parsePeer(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error but found %s for input %s", i, err, test.input)
+		}
+		if err != nil && !test.shouldErr {
+			t.Errorf("Test %d: Expected no error but found one for input %s. Error was: %v", i, test.input, err)
+		}
+		if test.shouldErr {
+			continue
+		}
+		if p.TLS == nil {
+			t.Errorf("Test %d, expected a TLS config", i)
+			continue
+		}
+		if p.TLS.ServerName != test.expectedServerName {
+			t.Errorf("Test %d, expected server name %q, got: %q", i, test.expectedServerName, p.TLS.ServerName)
+		}
+		if p.TLS.InsecureSkipVerify != test.expectedInsecure {
+			t.Errorf("Test %d, expected insecure_skip_verify %v, got: %v", i, test.expectedInsecure, p.TLS.InsecureSkipVerify)
+		}
+	}
+}
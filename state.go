@@ -0,0 +1,179 @@
+package zoneregistry
+
+import (
+	"net"
+	"time"
+)
+
+var (
+	riseDefault = uint32(1)
+	fallDefault = uint32(1)
+)
+
+// healthState tracks the consecutive results of a peer's health checks. It is
+// only accessed by the health checker.
+type healthState struct {
+	successes uint32
+	failures  uint32
+	changed   time.Time
+	up        time.Time
+	flaps     uint
+
+	// addrs and families hold the health of each address and address family,
+	// and streaks the consecutive results of their health checks
+	addrs    map[string]bool
+	families map[string]bool
+	streaks  map[string]*streak
+}
+
+// streak counts the consecutive successful or failed health checks of an
+// address or address family.
+type streak struct {
+	successes uint32
+	failures  uint32
+}
+
+// addressFamilies returns the result of each address family from the results
+// of the addresses, a family passing when any of its addresses does.
+func addressFamilies(addrs map[string]bool) map[string]bool {
+	families := map[string]bool{}
+	for addr, ok := range addrs {
+		family := ipFamily(net.ParseIP(addr))
+		families[family] = families[family] || ok
+	}
+	return families
+}
+
+// recordAddrs accounts for the result of a health check of each address of the
+// peer, a family passing when any of its addresses does. Like the peer, an
+// address or family changes health once its rise or fall threshold is reached.
+// The caller must hold p.mu.
+func (p *Peer) recordAddrs(results map[string]bool) {
+	s := &p.state
+	streaks := map[string]*streak{}
+	addrs := p.recordStreaks(results, s.addrs, streaks)
+	families := p.recordStreaks(addressFamilies(results), s.families, streaks)
+	s.addrs, s.families, s.streaks = addrs, families, streaks
+}
+
+// recordStreaks returns the health of each key of results, given its previous
+// health in prev, and adds the updated streak of each key to streaks.
+func (p *Peer) recordStreaks(results, prev map[string]bool, streaks map[string]*streak) map[string]bool {
+	health := map[string]bool{}
+	for key, ok := range results {
+		st := p.state.streaks[key]
+		if st == nil {
+			st = &streak{}
+		}
+		if ok {
+			st.successes++
+			st.failures = 0
+		} else {
+			st.failures++
+			st.successes = 0
+		}
+		streaks[key] = st
+
+		up, decided := prev[key]
+		switch {
+		case ok && st.successes >= p.Rise:
+			up, decided = true, true
+		case !ok && st.failures >= p.Fall:
+			up, decided = false, true
+		}
+		if decided {
+			health[key] = up
+		}
+	}
+	return health
+}
+
+// failedFamily returns the address family of the peer that is down while the
+// other one is up, if any. The caller must hold p.mu.
+func (p *Peer) failedFamily() string {
+	ipv4, ok4 := p.state.families[familyIPv4]
+	ipv6, ok6 := p.state.families[familyIPv6]
+	switch {
+	case !ok4 || !ok6:
+		return ""
+	case ipv4 && !ipv6:
+		return familyIPv6
+	case ipv6 && !ipv4:
+		return familyIPv4
+	}
+	return ""
+}
+
+// failedAddrs returns the addresses of the peer that are down while their
+// address family is up.
+func (p *Peer) failedAddrs() map[string]bool {
+	var failed map[string]bool
+	for addr, ok := range p.state.addrs {
+		if !ok && p.state.families[ipFamily(net.ParseIP(addr))] {
+			if failed == nil {
+				failed = map[string]bool{}
+			}
+			failed[addr] = true
+		}
+	}
+	return failed
+}
+
+// record accounts for the result of a health check done at now and updates the
+// peer's health once its rise or fall threshold is reached. It reports whether
+// the peer's health changed. The caller must hold p.mu.
+func (p *Peer) record(healthy bool, now time.Time) bool {
+	s := &p.state
+	if healthy {
+		s.successes++
+		s.failures = 0
+	} else {
+		s.failures++
+		s.successes = 0
+	}
+
+	switch {
+	case !p.Checked:
+		// The first health is decided as soon as a threshold is reached
+		if s.successes < p.Rise && s.failures < p.Fall {
+			return false
+		}
+
+	case p.Healthy:
+		if s.failures < p.Fall || now.Sub(s.changed) < p.Hold {
+			return false
+		}
+		// Going down shortly after coming up is a flap
+		if p.DampeningMax > 0 && now.Sub(s.up) < p.DampeningMax {
+			s.flaps++
+		} else {
+			s.flaps = 0
+		}
+
+	default:
+		if s.successes < p.Rise || now.Sub(s.changed) < p.holdDown() {
+			return false
+		}
+		s.up = now
+	}
+
+	p.Healthy = healthy
+	p.Checked = true
+	s.changed = now
+	return true
+}
+
+// holdDown returns the minimum time an unhealthy peer stays out of rotation.
+// Flapping peers are held down exponentially longer, up to DampeningMax.
+func (p *Peer) holdDown() time.Duration {
+	hold := p.Hold
+	if p.state.flaps == 0 || p.DampeningBase == 0 {
+		return hold
+	}
+
+	backoff := p.DampeningMax
+	if p.state.flaps < 32 && p.DampeningBase<<(p.state.flaps-1) < p.DampeningMax {
+		backoff = p.DampeningBase << (p.state.flaps - 1)
+	}
+	return max(hold, backoff)
+}
@@ -0,0 +1,72 @@
+package zoneregistry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	tests := []struct {
+		rise, fall    uint32
+		hold          time.Duration
+		dampening     [2]time.Duration
+		results       []bool
+		expectedState []bool // health after each result
+	}{
+		// Every result counts
+		{
+			rise: 1, fall: 1,
+			results:       []bool{true, false, true},
+			expectedState: []bool{true, false, true},
+		},
+		// A single failure doesn't pull the peer out of rotation
+		{
+			rise: 2, fall: 3,
+			results:       []bool{true, true, false, false, true, false, false, false},
+			expectedState: []bool{false, true, true, true, true, true, true, false},
+		},
+		// Each state is held for 3 checks
+		{
+			rise: 1, fall: 1, hold: 3 * time.Second,
+			results:       []bool{true, false, false, false, true, true},
+			expectedState: []bool{true, true, true, false, false, false},
+		},
+		// Each flap doubles the hold down, from 2 checks to 4 checks
+		{
+			rise: 1, fall: 1, dampening: [2]time.Duration{2 * time.Second, 10 * time.Second},
+			results:       []bool{true, false, true, false, true, true, false, true, true, true, true},
+			expectedState: []bool{true, false, true, false, false, true, false, false, false, false, true},
+		},
+	}
+
+	for i, test := range tests {
+		p := NewPeer()
+		p.Rise, p.Fall, p.Hold = test.rise, test.fall, test.hold
+		p.DampeningBase, p.DampeningMax = test.dampening[0], test.dampening[1]
+
+		now := time.Unix(0, 0)
+		for j, result := range test.results {
+			now = now.Add(time.Second)
+			p.record(result, now)
+			if p.Healthy != test.expectedState[j] {
+				t.Errorf("Test %d, check %d: expected healthy=%v, got: %v", i, j, test.expectedState[j], p.Healthy)
+			}
+		}
+	}
+}
+
+func TestRecordAddrs(t *testing.T) {
+	p := NewPeer()
+	p.Rise, p.Fall = 2, 2
+
+	// IPv4 passes every check, IPv6 fails once, then twice, then recovers
+	results := []bool{true, false, true, false, false, true, true}
+	expected := []string{"", "", "", "", familyIPv6, familyIPv6, ""}
+
+	for i, ipv6 := range results {
+		p.recordAddrs(map[string]bool{"127.0.0.1": true, "::1": ipv6})
+		if failed := p.failedFamily(); failed != expected[i] {
+			t.Errorf("Check %d: expected failed family %q, got: %q", i, expected[i], failed)
+		}
+	}
+}
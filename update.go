@@ -0,0 +1,444 @@
+package zoneregistry
+
+import (
+	"context"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// sourceUpdate is the source of the peers delegated through UPDATE messages.
+const sourceUpdate = "update"
+
+// acceptUpdates makes AcceptUpdateMessages idempotent.
+var acceptUpdates sync.Once
+
+// AcceptUpdateMessages widens the messages accepted by the DNS servers of the
+// process to UPDATE ones, which the dns library otherwise answers with NOTIMP
+// before they reach any plugin. CoreDNS doesn't let a plugin change what its
+// servers accept, so binaries using the update directive must call it before
+// starting CoreDNS. Other messages are accepted as before.
+func AcceptUpdateMessages() {
+	acceptUpdates.Do(func() {
+		dns.DefaultMsgAcceptFunc = updateAcceptFunc(dns.DefaultMsgAcceptFunc)
+	})
+}
+
+// updateAcceptFunc returns a dns.MsgAcceptFunc accepting UPDATE messages, and
+// deferring to next for the others.
+func updateAcceptFunc(next dns.MsgAcceptFunc) dns.MsgAcceptFunc {
+	return func(dh dns.Header) dns.MsgAcceptAction {
+		const qr = 1 << 15
+		if dh.Bits&qr == 0 && int(dh.Bits>>11)&0xF == dns.OpcodeUpdate && dh.Qdcount == 1 {
+			return dns.MsgAccept
+		}
+		return next(dh)
+	}
+}
+
+// updatesAccepted reports whether the DNS servers of the process pass UPDATE
+// messages on to the plugins.
+func updatesAccepted() bool {
+	return dns.DefaultMsgAcceptFunc(dns.Header{Bits: dns.OpcodeUpdate << 11, Qdcount: 1}) == dns.MsgAccept
+}
+
+// dynamicUpdate delegates peers through RFC 2136 UPDATE messages signed with
+// one of Keys, a map of TSIG key names to their base64 secrets. A peer is the
+// target of an NS record, the owner of the record being the subzone delegated
+// to it. The addresses of the target are its glue and its TXT record its labels.
+type dynamicUpdate struct {
+	Keys map[string]string
+
+	mu    sync.Mutex
+	names map[string]updateName
+	peers map[string]*Peer
+}
+
+// updateName holds the records of a name set through updates. Targets are the
+// hosts of the peers the name is delegated to, in the order they were added.
+type updateName struct {
+	Targets []string
+	IPv4    net.IP
+	IPv6    net.IP
+	Labels  []string
+}
+
+// updateHandover keeps the names of an instance stopped for a reload, by
+// zones, for the instance taking over the zones.
+var updateHandover = struct {
+	sync.Mutex
+	names map[string]map[string]updateName
+}{names: map[string]map[string]updateName{}}
+
+// suspendUpdates hands the names set through updates over to the instance
+// started by a reload.
+func (zr *ZoneRegistry) suspendUpdates() error {
+	if zr.Update == nil {
+		return nil
+	}
+	zr.Update.mu.Lock()
+	defer zr.Update.mu.Unlock()
+
+	updateHandover.Lock()
+	updateHandover.names[strings.Join(zr.Zones, " ")] = maps.Clone(zr.Update.names)
+	updateHandover.Unlock()
+	return nil
+}
+
+// resumeUpdates takes over the names handed over for the registry's zones, if
+// any, by a reloaded instance or back from a failed reload.
+func (zr *ZoneRegistry) resumeUpdates() error {
+	if zr.Update == nil {
+		return nil
+	}
+	updateHandover.Lock()
+	names, ok := updateHandover.names[strings.Join(zr.Zones, " ")]
+	delete(updateHandover.names, strings.Join(zr.Zones, " "))
+	updateHandover.Unlock()
+	if !ok {
+		return nil
+	}
+
+	u := zr.Update
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	peers := zr.updatePeers(names)
+	u.names = names
+	zr.setPeers(sourceUpdate, peers)
+	return nil
+}
+
+// dropUpdates forgets the names handed over for the registry's zones, left
+// when the instance taking over the zones doesn't accept updates.
+func (zr *ZoneRegistry) dropUpdates() {
+	if zr.Update == nil {
+		return
+	}
+	updateHandover.Lock()
+	delete(updateHandover.names, strings.Join(zr.Zones, " "))
+	updateHandover.Unlock()
+}
+
+// serveUpdate answers an UPDATE message for zone. The answer is signed with
+// the key of the message.
+func (zr *ZoneRegistry) serveUpdate(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, zone string) (int, error) {
+	start := time.Now()
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Rcode = zr.update(w, r, zone)
+	if t := r.IsTsig(); t != nil && w.TsigStatus() == nil {
+		msg.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+	return zr.writeMsg(ctx, w, msg, zone, start)
+}
+
+// update authenticates an UPDATE message for zone, checks its prerequisites
+// and applies it as a whole, or not at all. It returns the rcode of the answer.
+func (zr *ZoneRegistry) update(w dns.ResponseWriter, r *dns.Msg, zone string) int {
+	u := zr.Update
+	if u == nil {
+		return dns.RcodeNotImplemented
+	}
+	t := r.IsTsig()
+	if t == nil {
+		log.Warningf("Refused an unsigned update from %s", w.RemoteAddr())
+		return dns.RcodeRefused
+	}
+	if err := w.TsigStatus(); err != nil {
+		log.Warningf("Refused an update from %s signed with %s: %v", w.RemoteAddr(), t.Hdr.Name, err)
+		return dns.RcodeNotAuth
+	}
+	if _, ok := u.Keys[dns.CanonicalName(t.Hdr.Name)]; !ok {
+		log.Warningf("Refused an update from %s signed with unknown key %s", w.RemoteAddr(), t.Hdr.Name)
+		return dns.RcodeRefused
+	}
+	if q := r.Question[0]; q.Qtype != dns.TypeSOA || !strings.EqualFold(q.Name, zone) {
+		return dns.RcodeNotAuth
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if rcode := zr.prerequisites(r.Answer, zone); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	names, rcode := zr.applyUpdates(r.Ns, zone)
+	if rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	owners := map[string]string{}
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		for _, host := range names[name].Targets {
+			if owner, ok := owners[host]; ok {
+				log.Warningf("Refused the delegation of %s to %s, the host is already delegated %s", name, host, owner)
+				return dns.RcodeRefused
+			}
+			if zr.declared(host, u.peers[host]) {
+				log.Warningf("Refused the delegation of %s to %s, its host is already declared", name, host)
+				return dns.RcodeRefused
+			}
+			owners[host] = name
+		}
+	}
+
+	peers := zr.updatePeers(names)
+	u.names = names
+	zr.setPeers(sourceUpdate, peers)
+	log.Infof("Applied an update from %s signed with %s", w.RemoteAddr(), t.Hdr.Name)
+	return dns.RcodeSuccess
+}
+
+// prerequisites checks the prerequisite section of an UPDATE message against
+// the records set through updates, as per RFC 2136 section 3.2. The caller
+// must hold the lock of the updates.
+func (zr *ZoneRegistry) prerequisites(prereqs []dns.RR, zone string) int {
+	values := map[string][]dns.RR{}
+	for _, rr := range prereqs {
+		h := rr.Header()
+		name := dns.CanonicalName(h.Name)
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, name) {
+			return dns.RcodeNotZone
+		}
+		records := zr.updateRecords(name, zr.Update.names[name])
+
+		switch h.Class {
+		case dns.ClassANY:
+			if !isEmpty(rr) {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY && len(records) == 0 {
+				return dns.RcodeNameError
+			}
+			if h.Rrtype != dns.TypeANY && !slices.ContainsFunc(records, hasType(h.Rrtype)) {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if !isEmpty(rr) {
+				return dns.RcodeFormatError
+			}
+			if h.Rrtype == dns.TypeANY && len(records) > 0 {
+				return dns.RcodeYXDomain
+			}
+			if h.Rrtype != dns.TypeANY && slices.ContainsFunc(records, hasType(h.Rrtype)) {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := name + "/" + dns.TypeToString[h.Rrtype]
+			values[key] = append(values[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// Value dependent prerequisites must match the whole RRset
+	for _, rrs := range values {
+		h := rrs[0].Header()
+		name := dns.CanonicalName(h.Name)
+		var rrset []dns.RR
+		for _, rr := range zr.updateRecords(name, zr.Update.names[name]) {
+			if rr.Header().Rrtype == h.Rrtype {
+				rrset = append(rrset, rr)
+			}
+		}
+		if len(rrset) != len(rrs) {
+			return dns.RcodeNXRrset
+		}
+		for _, rr := range rrs {
+			if !slices.ContainsFunc(rrset, func(o dns.RR) bool { return equalRR(rr, o) }) {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdates applies the update section of an UPDATE message, as per RFC
+// 2136 section 3.4, to a copy of the names set through updates. The section is
+// checked as a whole before anything is applied. The caller must hold the lock
+// of the updates.
+func (zr *ZoneRegistry) applyUpdates(updates []dns.RR, zone string) (map[string]updateName, int) {
+	for _, rr := range updates {
+		h := rr.Header()
+		name := dns.CanonicalName(h.Name)
+		if !dns.IsSubDomain(zone, name) {
+			return nil, dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			switch h.Rrtype {
+			case dns.TypeNS, dns.TypeA, dns.TypeAAAA, dns.TypeTXT:
+			case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return nil, dns.RcodeFormatError
+			default:
+				// Only the records of peers can be added
+				return nil, dns.RcodeRefused
+			}
+			if isEmpty(rr) {
+				return nil, dns.RcodeFormatError
+			}
+			if name == dns.CanonicalName(zone) {
+				return nil, dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if h.Ttl != 0 || !isEmpty(rr) {
+				return nil, dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if h.Ttl != 0 || h.Rrtype == dns.TypeANY {
+				return nil, dns.RcodeFormatError
+			}
+		default:
+			return nil, dns.RcodeFormatError
+		}
+	}
+
+	names := maps.Clone(zr.Update.names)
+	if names == nil {
+		names = map[string]updateName{}
+	}
+	for _, rr := range updates {
+		h := rr.Header()
+		name := dns.CanonicalName(h.Name)
+		n := names[name]
+
+		switch h.Class {
+		case dns.ClassINET:
+			switch rr := rr.(type) {
+			case *dns.NS:
+				if target := dns.CanonicalName(rr.Ns); !slices.Contains(n.Targets, target) {
+					n.Targets = append(slices.Clip(n.Targets), target)
+				}
+			case *dns.A:
+				n.IPv4 = rr.A
+			case *dns.AAAA:
+				n.IPv6 = rr.AAAA
+			case *dns.TXT:
+				n.Labels = slices.Clone(rr.Txt)
+			}
+		case dns.ClassANY:
+			switch h.Rrtype {
+			case dns.TypeANY:
+				n = updateName{}
+			case dns.TypeNS:
+				n.Targets = nil
+			case dns.TypeA:
+				n.IPv4 = nil
+			case dns.TypeAAAA:
+				n.IPv6 = nil
+			case dns.TypeTXT:
+				n.Labels = nil
+			}
+		case dns.ClassNONE:
+			for _, o := range zr.updateRecords(name, n) {
+				if !equalRR(rr, o) {
+					continue
+				}
+				switch o := o.(type) {
+				case *dns.NS:
+					n.Targets = slices.DeleteFunc(slices.Clone(n.Targets), func(t string) bool { return t == o.Ns })
+				case *dns.A:
+					n.IPv4 = nil
+				case *dns.AAAA:
+					n.IPv6 = nil
+				case *dns.TXT:
+					n.Labels = nil
+				}
+			}
+		}
+
+		if len(n.Targets) > 0 || n.IPv4 != nil || n.IPv6 != nil || len(n.Labels) > 0 {
+			names[name] = n
+		} else {
+			delete(names, name)
+		}
+	}
+	return names, dns.RcodeSuccess
+}
+
+// updatePeers returns the peers the names are delegated to, sorted by host,
+// and keeps them for the next update. A host outside the zone has no glue, its
+// addresses are resolved. Peers whose records didn't change are kept, with
+// their health. The caller must hold the lock of the updates.
+func (zr *ZoneRegistry) updatePeers(names map[string]updateName) []*Peer {
+	u := zr.Update
+	peers := map[string]*Peer{}
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		for _, host := range names[name].Targets {
+			glue := names[host]
+			prev, ok := u.peers[host]
+			if ok && prev.Zone == name && prev.IPv4.Equal(glue.IPv4) && prev.IPv6.Equal(glue.IPv6) && slices.Equal(prev.Labels, glue.Labels) {
+				peers[host] = prev
+				continue
+			}
+			peer := NewPeer()
+			peer.Host, peer.Zone, peer.IPv4, peer.IPv6, peer.Labels = host, name, glue.IPv4, glue.IPv6, glue.Labels
+			peers[host] = peer
+		}
+	}
+	u.peers = peers
+
+	list := make([]*Peer, 0, len(peers))
+	for _, host := range slices.Sorted(maps.Keys(peers)) {
+		list = append(list, peers[host])
+	}
+	return list
+}
+
+// updateRecords returns the records of name set through updates.
+func (zr *ZoneRegistry) updateRecords(name string, n updateName) []dns.RR {
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: zr.TTL}
+	}
+	var records []dns.RR
+	for _, target := range n.Targets {
+		records = append(records, &dns.NS{Hdr: hdr(dns.TypeNS), Ns: target})
+	}
+	if n.IPv4 != nil {
+		records = append(records, &dns.A{Hdr: hdr(dns.TypeA), A: n.IPv4})
+	}
+	if n.IPv6 != nil {
+		records = append(records, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: n.IPv6})
+	}
+	if len(n.Labels) > 0 {
+		records = append(records, &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: n.Labels})
+	}
+	return records
+}
+
+// isEmpty reports whether rr has no data, as in the deletions and the
+// prerequisites on names and RRsets.
+func isEmpty(rr dns.RR) bool {
+	switch rr := rr.(type) {
+	case *dns.ANY, *dns.RR_Header:
+		return true
+	case *dns.NS:
+		// An empty target is packed as the root
+		return rr.Ns == ""
+	}
+	return dns.Len(rr) == dns.Len(&dns.ANY{Hdr: *rr.Header()})
+}
+
+// hasType returns a function reporting whether a record is of type rrtype.
+func hasType(rrtype uint16) func(dns.RR) bool {
+	return func(rr dns.RR) bool { return rr.Header().Rrtype == rrtype }
+}
+
+// equalRR reports whether a and b hold the same data, regardless of their
+// class and TTL.
+func equalRR(a, b dns.RR) bool {
+	ha, hb := *a.Header(), *b.Header()
+	if !strings.EqualFold(ha.Name, hb.Name) || ha.Rrtype != hb.Rrtype {
+		return false
+	}
+	a, b = dns.Copy(a), dns.Copy(b)
+	a.Header().Class, b.Header().Class = dns.ClassINET, dns.ClassINET
+	a.Header().Name = b.Header().Name
+	return dns.IsDuplicate(a, b)
+}
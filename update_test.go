@@ -0,0 +1,183 @@
+package zoneregistry
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSUpdate(t *testing.T) {
+	const (
+		key    = "update.example.org."
+		secret = "c2VjcmV0LWtleS1mb3ItdXBkYXRlcw=="
+	)
+	zr := newTestZoneRegistry()
+	zr.Update = &dynamicUpdate{Keys: map[string]string{key: secret}}
+
+	// The server also knows a key that isn't allowed to update
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	started := make(chan struct{})
+	s := &dns.Server{
+		PacketConn:        pc,
+		TsigSecret:        map[string]string{key: secret, "other.example.org.": secret},
+		MsgAcceptFunc:     updateAcceptFunc(dns.DefaultMsgAcceptFunc),
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			zr.ServeDNS(context.TODO(), w, r)
+		}),
+	}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	<-started
+
+	exchange := func(name, keySecret string, prereqs, updates []dns.RR) int {
+		m := new(dns.Msg)
+		m.SetUpdate("example.org.")
+		m.Answer, m.Ns = prereqs, updates
+		c := new(dns.Client)
+		if name != "" {
+			m.SetTsig(name, dns.HmacSHA256, 300, time.Now().Unix())
+			c.TsigSecret = map[string]string{name: keySecret}
+		}
+		resp, _, err := c.Exchange(m, pc.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return resp.Rcode
+	}
+	remove := func(rr dns.RR) dns.RR {
+		rr.Header().Class, rr.Header().Ttl = dns.ClassNONE, 0
+		return rr
+	}
+	delegation := []dns.RR{
+		test.NS("peer2.example.org. 300 IN NS peer2.example.org."),
+		test.A("peer2.example.org. 300 IN A 10.0.0.2"),
+		test.TXT(`peer2.example.org. 300 IN TXT "cluster-env=staging"`),
+	}
+	notInUse := []dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "peer2.example.org.", Rrtype: dns.TypeANY, Class: dns.ClassNONE}}}
+
+	tests := []struct {
+		name, secret     string
+		prereqs, updates []dns.RR
+		expectedRcode    int
+		expectedPeers    int
+	}{
+		{"", "", nil, delegation, dns.RcodeRefused, 1},
+		{key, "d3Jvbmc=", nil, delegation, dns.RcodeNotAuth, 1},
+		{"other.example.org.", secret, nil, delegation, dns.RcodeRefused, 1},
+		{key, secret, nil, []dns.RR{test.A("peer2.example.net. 300 IN A 10.0.0.2")}, dns.RcodeNotZone, 1},
+		{key, secret, nil, []dns.RR{test.NS("peer2.example.org. 300 IN NS peer1.example.org.")}, dns.RcodeRefused, 1},
+		{key, secret, nil, []dns.RR{test.NS("peer1.example.org. 300 IN NS peer1.example.org.")}, dns.RcodeRefused, 1},
+		{key, secret, nil, []dns.RR{test.MX("peer2.example.org. 300 IN MX 10 mx.example.org.")}, dns.RcodeRefused, 1},
+		{key, secret, notInUse, delegation, dns.RcodeSuccess, 2},
+		{key, secret, notInUse, delegation, dns.RcodeYXDomain, 2},
+		{key, secret, nil, []dns.RR{remove(test.A("peer2.example.org. 300 IN A 10.0.0.2"))}, dns.RcodeSuccess, 2},
+		{key, secret, nil, []dns.RR{remove(test.NS("peer2.example.org. 300 IN NS peer2.example.org."))}, dns.RcodeSuccess, 1},
+		// Peers may be outside the zone, but a host is delegated a single name
+		{key, secret, nil, []dns.RR{test.NS("cluster3.example.org. 300 IN NS ns.example.net.")}, dns.RcodeSuccess, 2},
+		{key, secret, nil, []dns.RR{test.NS("cluster4.example.org. 300 IN NS ns.example.net.")}, dns.RcodeRefused, 2},
+		{key, secret, nil, []dns.RR{test.A("ns.example.net. 300 IN A 10.0.0.3")}, dns.RcodeNotZone, 2},
+		{key, secret, nil, []dns.RR{remove(test.NS("cluster3.example.org. 300 IN NS ns.example.net."))}, dns.RcodeSuccess, 1},
+	}
+	for i, test := range tests {
+		if rcode := exchange(test.name, test.secret, test.prereqs, test.updates); rcode != test.expectedRcode {
+			t.Errorf("Test %d: Expected rcode %s, got %s", i, dns.RcodeToString[test.expectedRcode], dns.RcodeToString[rcode])
+		}
+		zr.mu.RLock()
+		if len(zr.Peers) != test.expectedPeers {
+			t.Errorf("Test %d: Expected %d peers, got %d", i, test.expectedPeers, len(zr.Peers))
+		}
+		zr.mu.RUnlock()
+	}
+
+	// The records of a name that is no longer delegated are kept
+	zr.Update.mu.Lock()
+	n := zr.Update.names["peer2.example.org."]
+	zr.Update.mu.Unlock()
+	if len(n.Targets) > 0 || n.IPv4 != nil || len(n.Labels) != 1 {
+		t.Errorf("Expected only the TXT record of peer2 left, got %+v", n)
+	}
+}
+
+func TestUpdatePeers(t *testing.T) {
+	zr := newTestZoneRegistry()
+	zr.Update = &dynamicUpdate{Keys: map[string]string{}}
+	apply := func(updates ...dns.RR) {
+		t.Helper()
+		zr.Update.mu.Lock()
+		defer zr.Update.mu.Unlock()
+		names, rcode := zr.applyUpdates(updates, "example.org.")
+		if rcode != dns.RcodeSuccess {
+			t.Fatalf("Expected rcode NOERROR, got %s", dns.RcodeToString[rcode])
+		}
+		zr.Update.names = names
+		zr.setPeers(sourceUpdate, zr.updatePeers(names))
+	}
+
+	apply(test.NS("peer2.example.org. 300 IN NS peer2.example.org."), test.AAAA("peer2.example.org. 300 IN AAAA 2001:db8::2"))
+	peer := zr.peer("peer2.example.org.")
+	if peer == nil || !peer.IPv6.Equal(net.ParseIP("2001:db8::2")) {
+		t.Fatalf("Expected peer2 with its IPv6 glue, got %+v", peer)
+	}
+
+	// Adding the same records again keeps the peer and its health
+	apply(test.NS("peer2.example.org. 300 IN NS peer2.example.org."))
+	if zr.peer("peer2.example.org.") != peer {
+		t.Errorf("Expected an unchanged delegation to keep the peer")
+	}
+	apply(test.A("peer2.example.org. 300 IN A 10.0.0.2"))
+	if p := zr.peer("peer2.example.org."); p == peer || !p.IPv4.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Expected new glue to replace the peer, got %+v", p)
+	}
+
+	// The delegations survive a reload
+	zr.suspendUpdates()
+	reloaded := newTestZoneRegistry()
+	reloaded.Update = &dynamicUpdate{Keys: map[string]string{}}
+	reloaded.resumeUpdates()
+	if p := reloaded.peer("peer2.example.org."); p == nil || !p.IPv4.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Expected peer2 to be taken over by the reloaded instance, got %+v", p)
+	}
+
+	// Names left over by a reload to an instance without updates are dropped
+	zr.suspendUpdates()
+	zr.OnShutdown()
+	reloaded = newTestZoneRegistry()
+	reloaded.Update = &dynamicUpdate{Keys: map[string]string{}}
+	reloaded.resumeUpdates()
+	if p := reloaded.peer("peer2.example.org."); p != nil {
+		t.Errorf("Expected the names of a stopped instance to be dropped, got %+v", p)
+	}
+
+	// A subzone delegated to another host gets the host and its glue as peer
+	apply(test.NS("cluster3.example.org. 300 IN NS ns.cluster3.example.org."), test.A("ns.cluster3.example.org. 300 IN A 10.0.0.3"))
+	peer = zr.peer("ns.cluster3.example.org.")
+	if peer == nil || peer.Zone != "cluster3.example.org." || !peer.IPv4.Equal(net.ParseIP("10.0.0.3")) {
+		t.Fatalf("Expected ns.cluster3 with its IPv4 glue delegated cluster3, got %+v", peer)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("www.cluster3.example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	zr.ServeDNS(context.TODO(), rec, m)
+	if ns, ok := rec.Msg.Ns[0].(*dns.NS); len(rec.Msg.Ns) != 1 || !ok || ns.Hdr.Name != "cluster3.example.org." || ns.Ns != "ns.cluster3.example.org." {
+		t.Errorf("Expected a referral of cluster3 to ns.cluster3, got %v", rec.Msg.Ns)
+	}
+	apply(&dns.ANY{Hdr: dns.RR_Header{Name: "cluster3.example.org.", Rrtype: dns.TypeANY, Class: dns.ClassANY}})
+	if zr.peer("ns.cluster3.example.org.") != nil {
+		t.Errorf("Expected the deletion of the delegation to remove ns.cluster3")
+	}
+	apply(&dns.ANY{Hdr: dns.RR_Header{Name: "ns.cluster3.example.org.", Rrtype: dns.TypeANY, Class: dns.ClassANY}})
+
+	apply(&dns.ANY{Hdr: dns.RR_Header{Name: "peer2.example.org.", Rrtype: dns.TypeANY, Class: dns.ClassANY}})
+	if zr.peer("peer2.example.org.") != nil || len(zr.Update.names) != 0 {
+		t.Errorf("Expected the deletion of the name to remove peer2")
+	}
+}
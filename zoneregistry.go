@@ -1,8 +1,10 @@
 package zoneregistry
 
 import (
+	"cmp"
 	"context"
-	"net/http"
+	"math/rand/v2"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,6 +21,28 @@ var (
 	ttlDefault      = uint32(300)
 	intervalDefault = uint32(60)
 	timeoutDefault  = uint32(5)
+	backoffDefault  = time.Second
+	workersDefault  = uint32(32)
+	modeDefault     = modeReferral
+	initialDefault  = initialUnknown
+)
+
+const (
+	// initialHealthy puts peers in rotation until their first health check fails.
+	initialHealthy = "healthy"
+	// initialUnhealthy keeps peers out of rotation until their first health check succeeds.
+	initialUnhealthy = "unhealthy"
+	// initialUnknown only uses peers that weren't checked yet when no peer is healthy.
+	initialUnknown = "unknown"
+)
+
+const (
+	// modeReferral delegates names to the healthy peers with NS records and glue.
+	modeReferral = "referral"
+	// modeAnswer answers address queries with the healthy peers' addresses.
+	modeAnswer = "answer"
+	// modeProxy forwards queries to a healthy peer and relays its answer.
+	modeProxy = "proxy"
 )
 
 type ZoneRegistry struct {
@@ -27,11 +51,85 @@ type ZoneRegistry struct {
 	TTL      uint32
 	Interval uint32
 	Timeout  uint32
+	Mode     string
+	Balancer Balancer
 	Fall     fall.F
 
-	Peers []*Peer
-	mu    sync.RWMutex
-	index int
+	// Retries is the number of health check attempts made after a failed one,
+	// RetryBackoff the delay before the first retry.
+	Retries      uint32
+	RetryBackoff time.Duration
+
+	// MaxConcurrentChecks is the number of peers probed at the same time.
+	// Jitter spreads the probes of a cycle over a random delay up to its value.
+	MaxConcurrentChecks uint32
+	Jitter              time.Duration
+
+	// InitialState is how peers are treated before their first health check.
+	InitialState string
+
+	SOA         SOA
+	Nameservers []*Nameserver
+	Services    []string
+	Glue        []string
+
+	// PeersFile, if set, adds the peers of a file watched for changes.
+	// Discoveries add the peers published in SRV records.
+	// Registration, if set, serves an API through which peers register
+	// themselves. Update, if set, delegates peers through UPDATE messages.
+	PeersFile    *peersFile
+	Discoveries  []*srvDiscovery
+	Registration *registration
+	Update       *dynamicUpdate
+
+	// Upstream resolves the hosts of the peers without addresses, every
+	// ResolveInterval.
+	Upstream        string
+	ResolveInterval time.Duration
+	// upstream is the resolver in use, Upstream or the system's by default.
+	upstream string
+
+	Peers   []*Peer
+	sources map[string][]*Peer
+	mu      sync.RWMutex
+	health  atomic.Pointer[healthSnapshot]
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	ready  atomic.Bool
+	// started is done once the background tasks gathering the peers on
+	// startup completed their first run, awaited by the first health check
+	// cycle.
+	started sync.WaitGroup
+}
+
+// healthSnapshot is an immutable view of the peers' health, published at the
+// end of every health check cycle.
+type healthSnapshot struct {
+	primary   []*Peer
+	secondary []*Peer
+	unknown   []*Peer
+	peers     []*Peer
+	// fallback holds the peers used when none is healthy, all of them but
+	// the unchecked ones with the unhealthy initial state.
+	fallback []*Peer
+
+	// failed holds the address family left out of the records of a peer
+	// healthy on its other address family only, and down the addresses left
+	// out while another address of their family is healthy.
+	failed map[*Peer]string
+	down   map[*Peer]map[string]bool
+
+	// hosts indexes the peers by host, and zones by delegated subzone, both
+	// canonical, for the queries not to scan the peers.
+	hosts map[string]*Peer
+	zones map[string][]*Peer
+	// healthy holds the peers in rotation, the unchecked ones included with
+	// the healthy initial state.
+	healthy map[*Peer]bool
+
+	unhealthyPrimary   int
+	unhealthySecondary int
 }
 
 func newZoneRegistry() *ZoneRegistry {
@@ -39,6 +137,15 @@ func newZoneRegistry() *ZoneRegistry {
 		TTL:      ttlDefault,
 		Interval: intervalDefault,
 		Timeout:  timeoutDefault,
+		Mode:     modeDefault,
+		Balancer: newBalancer(lbDefault),
+		SOA:      newSOA(),
+		Glue:     allFamilies,
+
+		RetryBackoff:        backoffDefault,
+		InitialState:        initialDefault,
+		MaxConcurrentChecks: workersDefault,
+		ResolveInterval:     resolveIntervalDefault,
 	}
 }
 
@@ -57,6 +164,10 @@ func (zr *ZoneRegistry) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *d
 	zone = qname[len(qname)-len(zone):] // maintain case of original query
 	log.Debugf("Computed zone %s", zone)
 
+	if r.Opcode == dns.OpcodeUpdate {
+		return zr.serveUpdate(ctx, w, r, zone)
+	}
+
 	subdomain := strings.SplitN(qname, zone, 2)[0]
 	log.Debugf("Computed subdomain %s", subdomain)
 
@@ -65,29 +176,172 @@ func (zr *ZoneRegistry) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *d
 	msg.SetReply(state.Req)
 	msg.Authoritative = true
 
-	healthyPeers := zr.GetHealthyPeers()
+	var delegated []*Peer
+	prefix := subdomain
+	subzone := false
+
+	name := state.Name()
+	ns, peer := zr.nameserver(name, zone), zr.peer(name)
+	cut, parents := zr.parentPeers(name)
+	switch {
+	case subdomain == "":
+		zr.serveApex(msg, state.QType(), zone)
+
+	case ns != nil:
+		msg.Answer = zr.addressRecords(qname, state.QType(), ns.IPv4, ns.IPv6)
+
+	case peer != nil:
+		if state.QType() == dns.TypeTXT {
+			msg.Answer = []dns.RR{zr.txtRecord(qname, peer.Labels)}
+			break
+		}
+		msg.Answer = zr.peerAddressRecords(qname, state.QType(), peer, allFamilies)
 
-	// Rotate the list based on the round-robin index
-	n := len(healthyPeers)
-	lbPeers := make([]*Peer, n)
-	if zr.index >= n {
-		zr.index = 0 // Reset index to prevent OOB errors
+	case cut == name && state.QType() == dns.TypeDS:
+		// The registry is the parent side of the delegation and holds no DS
+		// records, leave the answer empty for an authoritative NODATA.
+
+	case len(parents) > 0:
+		// The name is inside the peers' own subzone
+		delegated, prefix, subzone = parents, "", true
+
+	case zr.isService(subdomain):
+		peers := zr.GetHealthyPeers()
+		if len(peers) == 0 {
+			log.Debugf("No peers to delegate %s to", qname)
+			msg.Rcode = dns.RcodeNameError
+			break
+		}
+		peers = zr.Balancer.Balance(peers)
+		if zr.Mode != modeProxy && zr.serveService(msg, state, peers) {
+			break
+		}
+		delegated = peers
+
+	default:
+		log.Debugf("Request %s does not match any registry name", qname)
+		msg.Rcode = dns.RcodeNameError
 	}
-	copy(lbPeers, healthyPeers[zr.index:])
-	copy(lbPeers[n-zr.index:], healthyPeers[:zr.index])
-	zr.index = (zr.index + 1) % n
 
-	for _, peer := range lbPeers {
-		msg.Ns = append(msg.Ns, &dns.NS{Hdr: dns.RR_Header{Name: subdomain + peer.Host, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: zr.TTL}, Ns: peer.Host})
+	// ANY queries for a name of the registry get the minimal answer of RFC 8482
+	if state.QType() == dns.TypeANY && msg.Rcode == dns.RcodeSuccess && !subzone {
+		msg.Answer, msg.Ns, msg.Extra = []dns.RR{zr.hinfoRecord(qname)}, nil, nil
+		delegated = nil
+	}
 
-		if peer.IPv4 != nil {
-			msg.Extra = append(msg.Extra, &dns.A{Hdr: dns.RR_Header{Name: peer.Host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: zr.TTL}, A: peer.IPv4})
+	if len(delegated) > 0 {
+		switch {
+		case zr.Mode == modeProxy:
+			return zr.serveProxy(ctx, w, state, zone, start, delegated)
+		case subzone:
+			// Only the peer has the records of its subzone, the registry
+			// refers to it whatever the mode
+			zr.serveReferral(msg, prefix, delegated)
+		default:
+			zr.serveDelegation(msg, state, prefix, delegated)
 		}
-		if peer.IPv6 != nil {
-			msg.Extra = append(msg.Extra, &dns.AAAA{Hdr: dns.RR_Header{Name: peer.Host, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: zr.TTL}, AAAA: peer.IPv6})
+	}
+
+	// Negative answers either fall through or carry the SOA in the authority section
+	if msg.Rcode == dns.RcodeNameError || (len(msg.Answer) == 0 && len(msg.Ns) == 0) {
+		if zr.Fall.Through(qname) {
+			return plugin.NextOrFailure(zr.Name(), zr.Next, ctx, w, r)
 		}
+		msg.Ns = []dns.RR{zr.negativeSOA(zone)}
 	}
 
+	return zr.writeMsg(ctx, w, msg, zone, start)
+}
+
+// serveDelegation answers a query for a name delegated to peers according to
+// the registry mode.
+func (zr *ZoneRegistry) serveDelegation(msg *dns.Msg, state request.Request, subdomain string, peers []*Peer) {
+	switch zr.Mode {
+	case modeAnswer:
+		for _, peer := range peers {
+			msg.Answer = append(msg.Answer, zr.peerAddressRecords(state.QName(), state.QType(), peer, allFamilies)...)
+		}
+	default:
+		zr.serveReferral(msg, subdomain, peers)
+	}
+}
+
+// serveReferral delegates subdomain to peers, with their addresses as glue.
+func (zr *ZoneRegistry) serveReferral(msg *dns.Msg, subdomain string, peers []*Peer) {
+	// Referrals are not authoritative data, the answer belongs to the peers
+	msg.Authoritative = false
+
+	for _, peer := range peers {
+		msg.Ns = append(msg.Ns, &dns.NS{Hdr: dns.RR_Header{Name: subdomain + peer.zone(), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: zr.TTL}, Ns: peer.Host})
+		msg.Extra = append(msg.Extra, zr.peerAddressRecords(peer.Host, dns.TypeANY, peer, zr.Glue)...)
+	}
+}
+
+// nameserver returns the registry nameserver of zone whose host is name, if
+// any, including the default one.
+func (zr *ZoneRegistry) nameserver(name, zone string) *Nameserver {
+	for _, ns := range zr.nameservers(zone) {
+		if strings.EqualFold(ns.Host, name) {
+			return ns
+		}
+	}
+	return nil
+}
+
+// peer returns the peer whose host is name, if any, from the last published
+// health snapshot.
+func (zr *ZoneRegistry) peer(name string) *Peer {
+	snap := zr.health.Load()
+	if snap == nil {
+		return nil
+	}
+	return snap.hosts[dns.CanonicalName(name)]
+}
+
+// parentPeers returns the closest subzone delegated to peers containing name,
+// if any, and its healthy peers from the last published health snapshot. When
+// none is healthy, all of them are returned, only they holding the records of
+// the subzone.
+func (zr *ZoneRegistry) parentPeers(name string) (string, []*Peer) {
+	snap := zr.health.Load()
+	if snap == nil {
+		return "", nil
+	}
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		peers := snap.zones[name[off:]]
+		if len(peers) == 0 {
+			continue
+		}
+		healthy := slices.DeleteFunc(slices.Clone(peers), func(p *Peer) bool { return !snap.healthy[p] })
+		if len(healthy) == 0 {
+			return name[off:], peers
+		}
+		return name[off:], healthy
+	}
+	return "", nil
+}
+
+// isService reports whether subdomain is delegated to the healthy peers, as
+// one of the services or a name below one. Without any configured services,
+// every name in the zone is.
+func (zr *ZoneRegistry) isService(subdomain string) bool {
+	if len(zr.Services) == 0 {
+		return true
+	}
+	sub := strings.ToLower(strings.TrimSuffix(subdomain, "."))
+	for _, s := range zr.Services {
+		if sub == s || strings.HasSuffix(sub, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (zr *ZoneRegistry) Name() string { return pluginName }
+
+// writeMsg sends msg to the client and records the query metrics.
+func (zr *ZoneRegistry) writeMsg(ctx context.Context, w dns.ResponseWriter, msg *dns.Msg, zone string, start time.Time) (int, error) {
 	if err := w.WriteMsg(msg); err != nil {
 		log.Errorf("Failed to send a response: %s", err)
 		return dns.RcodeServerFailure, err
@@ -98,75 +352,314 @@ func (zr *ZoneRegistry) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *d
 	return dns.RcodeSuccess, nil
 }
 
-func (zr *ZoneRegistry) Name() string { return pluginName }
-
+// GetHealthyPeers returns the healthy primary peers, or the healthy secondary
+// peers when no primary is healthy, from the last published health snapshot.
+// Without any healthy peer, the peers that weren't checked yet are returned,
+// then all peers, but for the unchecked ones with the unhealthy initial state:
+// none is returned until a peer is checked. Healthy peers are ordered by the load they reported, see
+// byLoad. The returned slice may be shared and must not be modified.
 func (zr *ZoneRegistry) GetHealthyPeers() []*Peer {
+	snap := zr.health.Load()
+	if snap == nil {
+		return nil
+	}
+
+	if len(snap.primary) > 0 {
+		return byLoad(snap.primary)
+	}
+	if len(snap.secondary) > 0 {
+		return byLoad(snap.secondary)
+	}
+	if len(snap.unknown) > 0 {
+		return snap.unknown
+	}
+
+	// Return all peers if none are healthy
+	log.Debugf("No healthy peers found, returning all peers")
+	return snap.fallback
+}
+
+// byLoad orders peers by the weight derived from their reported load or
+// capacity, the least loaded first, the order kept by the first balancer. Peers reporting no
+// capacity left are left out unless they all are. Peers are returned as is
+// when none reported anything.
+func byLoad(peers []*Peer) []*Peer {
+	if !reportsLoad(peers) {
+		return peers
+	}
+
+	weights := make(map[*Peer]float64, len(peers))
+	var available []*Peer
+	for _, p := range peers {
+		weights[p] = p.weight()
+		if weights[p] > 0 {
+			available = append(available, p)
+		}
+	}
+	if len(available) == 0 {
+		available = append(available, peers...)
+	}
+	slices.SortStableFunc(available, func(a, b *Peer) int { return cmp.Compare(weights[b], weights[a]) })
+	return available
+}
+
+// publishHealth builds a snapshot of the peers' current health and makes it
+// visible to the query path.
+func (zr *ZoneRegistry) publishHealth() *healthSnapshot {
 	zr.mu.RLock()
-	defer zr.mu.RUnlock()
+	snap := &healthSnapshot{
+		peers:   append([]*Peer(nil), zr.Peers...),
+		failed:  map[*Peer]string{},
+		down:    map[*Peer]map[string]bool{},
+		hosts:   map[string]*Peer{},
+		zones:   map[string][]*Peer{},
+		healthy: map[*Peer]bool{},
+	}
+	zr.mu.RUnlock()
+
+	for _, peer := range snap.peers {
+		if peer.Host != "" {
+			host, zone := dns.CanonicalName(peer.Host), dns.CanonicalName(peer.zone())
+			if _, ok := snap.hosts[host]; !ok {
+				snap.hosts[host] = peer
+			}
+			snap.zones[zone] = append(snap.zones[zone], peer)
+		}
+
+		peer.mu.Lock()
+		if family := peer.failedFamily(); family != "" {
+			snap.failed[peer] = family
+		}
+		if addrs := peer.failedAddrs(); addrs != nil {
+			snap.down[peer] = addrs
+		}
+		healthy, checked := peer.Healthy, peer.Checked
+		peer.mu.Unlock()
 
-	healthyPrimaryPeers := make([]*Peer, 0, len(zr.Peers))
-	healthySecondaryPeers := make([]*Peer, 0, len(zr.Peers))
-	for _, peer := range zr.Peers {
-		if peer.Healthy && peer.Role == "primary" {
-			healthyPrimaryPeers = append(healthyPrimaryPeers, peer)
+		if !checked {
+			switch zr.InitialState {
+			case initialHealthy:
+				healthy = true
+			case initialUnknown:
+				snap.unknown = append(snap.unknown, peer)
+			}
 		}
-		if peer.Healthy && peer.Role == "secondary" {
-			healthySecondaryPeers = append(healthySecondaryPeers, peer)
+		if checked || zr.InitialState != initialUnhealthy {
+			snap.fallback = append(snap.fallback, peer)
+		}
+		if healthy {
+			snap.healthy[peer] = true
+		}
+
+		switch {
+		case peer.Role == "primary" && healthy:
+			snap.primary = append(snap.primary, peer)
+		case peer.Role == "primary":
+			snap.unhealthyPrimary++
+		case peer.Role == "secondary" && healthy:
+			snap.secondary = append(snap.secondary, peer)
+		case peer.Role == "secondary":
+			snap.unhealthySecondary++
 		}
 	}
+	zr.health.Store(snap)
+	return snap
+}
+
+// StartHealthChecks probes the peers once the ones gathered on startup are
+// known, then every Interval, until ctx is cancelled.
+func (zr *ZoneRegistry) StartHealthChecks(ctx context.Context) {
+	zr.started.Wait()
+
+	ticker := time.NewTicker(time.Duration(zr.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		zr.checkPeers(ctx)
 
-	if len(healthyPrimaryPeers) > 0 {
-		return healthyPrimaryPeers
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
-	if len(healthySecondaryPeers) > 0 {
-		return healthySecondaryPeers
+}
+
+// OnStartup starts the health checks of the peers, the resolution of their
+// hosts, the watch of the peers file and of the discoveries, and the
+// registration API. The peers delegated through updates are taken over from a
+// reloaded instance. Peers are discovered and resolved once before the first
+// health check cycle.
+func (zr *ZoneRegistry) OnStartup() error {
+	// The registration API is the only part that can fail, it is started
+	// before any background task
+	if err := zr.startRegistration(); err != nil {
+		return err
 	}
 
-	// Return all peers if none are healthy
-	log.Debugf("No healthy peers found, returning all peers")
-	healthyPrimaryPeers = append(healthyPrimaryPeers, zr.Peers...)
-	return healthyPrimaryPeers
+	ctx, cancel := context.WithCancel(context.Background())
+	zr.cancel = cancel
+
+	for _, d := range zr.Discoveries {
+		zr.wg.Add(1)
+		zr.started.Add(1)
+		go func() {
+			defer zr.wg.Done()
+			zr.discover(ctx, d)
+			zr.started.Done()
+			zr.watchDiscovery(ctx, d)
+		}()
+	}
+
+	zr.upstream = zr.Upstream
+	if zr.upstream == "" {
+		upstream, err := defaultResolver()
+		if err != nil {
+			log.Warningf("Peers without addresses won't be resolved: %v", err)
+		}
+		zr.upstream = upstream
+	}
+	zr.wg.Add(1)
+	zr.started.Add(1)
+	go func() {
+		defer zr.wg.Done()
+		zr.resolvePeers(ctx)
+		zr.started.Done()
+		zr.watchResolution(ctx)
+	}()
+
+	zr.wg.Add(1)
+	go func() {
+		defer zr.wg.Done()
+		zr.StartHealthChecks(ctx)
+	}()
+
+	if zr.PeersFile != nil && zr.PeersFile.Reload > 0 {
+		zr.wg.Add(1)
+		go func() {
+			defer zr.wg.Done()
+			zr.watchPeersFile(ctx)
+		}()
+	}
+	zr.resumeUpdates()
+	return nil
 }
 
-func (zr *ZoneRegistry) StartHealthChecks() {
+// OnShutdown stops the health checks and waits for the probes in flight to
+// return, so that a reloaded instance doesn't overlap with this one. The
+// connections kept open to the peers and the registration API are closed.
+func (zr *ZoneRegistry) OnShutdown() error {
+	if zr.cancel != nil {
+		zr.cancel()
+	}
+	zr.wg.Wait()
+	if err := zr.stopRegistration(); err != nil {
+		log.Warningf("Failed to stop the registration API: %v", err)
+	}
+	zr.dropUpdates()
+
+	zr.mu.RLock()
+	defer zr.mu.RUnlock()
+	for _, p := range zr.Peers {
+		p.closeIdleConnections()
+	}
+	return nil
+}
+
+// checkPeers probes the peers with a pool of MaxConcurrentChecks workers and
+// publishes the results. No lock is held while probing, queries keep being
+// answered from the previous snapshot.
+func (zr *ZoneRegistry) checkPeers(ctx context.Context) {
 	var wg sync.WaitGroup
-	ticker := time.NewTicker(time.Duration(zr.Interval) * time.Second)
-	defer ticker.Stop()
 
-	for range ticker.C {
-		zr.mu.Lock()
-		hp_count := atomic.Uint32{}
-		hs_count := atomic.Uint32{}
-		for _, p := range zr.Peers {
-			wg.Add(1)
-			go func(p *Peer) {
-				defer wg.Done()
-				client := &http.Client{
-					Timeout: time.Duration(zr.Timeout) * time.Second,
+	zr.mu.RLock()
+	peers := append([]*Peer(nil), zr.Peers...)
+	zr.mu.RUnlock()
+
+	opts := probeOptions{
+		Timeout: time.Duration(zr.Timeout) * time.Second,
+		Retries: zr.Retries,
+		Backoff: zr.RetryBackoff,
+	}
+	work := make(chan *Peer)
+	for range min(int(zr.MaxConcurrentChecks), len(peers)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				if p.needsResolution() && p.resolved.Load() == nil {
+					zr.resolvePeer(ctx, p)
 				}
 
-				status := p.isHealthy(client)
-				if p.Healthy != status {
-					log.Debugf("Peer %s changed state: Ready=%v\n", p.Host, status)
+				opts := opts
+				if p.Retries != nil {
+					opts.Retries = *p.Retries
 				}
-				p.Healthy = status
-
-				// Track peer count for metrics
-				if status == true {
-					if p.Role == "primary" {
-						hp_count.Add(1)
-					} else {
-						hs_count.Add(1)
-					}
+				status := p.isHealthy(ctx, opts)
+				p.mu.Lock()
+				changed := p.record(status, time.Now())
+				p.mu.Unlock()
+				if changed {
+					log.Debugf("Peer %s changed state: Ready=%v\n", p.Host, status)
 				}
-			}(p)
+			}
+		}()
+	}
+	zr.dispatch(ctx, peers, work)
+	close(work)
+	wg.Wait()
+
+	// Results of probes aborted by a shutdown are meaningless
+	if ctx.Err() != nil {
+		return
+	}
+	snap := zr.publishHealth()
+
+	healthyPeers.WithLabelValues("primary").Set(float64(len(snap.primary)))
+	healthyPeers.WithLabelValues("secondary").Set(float64(len(snap.secondary)))
+	unhealthyPeers.WithLabelValues("primary").Set(float64(snap.unhealthyPrimary))
+	unhealthyPeers.WithLabelValues("secondary").Set(float64(snap.unhealthySecondary))
+
+	if !zr.ready.Swap(true) {
+		log.Infof("First health check cycle done for %d peers", len(peers))
+	}
+}
+
+// dispatch sends each peer to the workers after a random delay up to Jitter,
+// so that the probes of a cycle don't all start at once. It returns early when
+// ctx is cancelled.
+func (zr *ZoneRegistry) dispatch(ctx context.Context, peers []*Peer, work chan<- *Peer) {
+	delays := make([]time.Duration, len(peers))
+	if zr.Jitter > 0 {
+		for i := range delays {
+			delays[i] = rand.N(zr.Jitter)
 		}
-		wg.Wait()
-		zr.mu.Unlock()
+	}
+	order := make([]int, len(peers))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int { return cmp.Compare(delays[a], delays[b]) })
 
-		healthyPeers.WithLabelValues("primary").Set(float64(hp_count.Load()))
-		healthyPeers.WithLabelValues("secondary").Set(float64(hs_count.Load()))
-		unhealthyPeers.WithLabelValues("primary").Set(float64(len(zr.Peers) - int(hp_count.Load())))
-		unhealthyPeers.WithLabelValues("secondary").Set(float64(len(zr.Peers) - int(hs_count.Load())))
+	start := time.Now()
+	for _, i := range order {
+		if wait := time.Until(start.Add(delays[i])); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case work <- peers[i]:
+		}
 	}
 }
+
+// Ready implements the ready.Readiness interface. The registry is ready once
+// every peer went through a health check.
+func (zr *ZoneRegistry) Ready() bool { return zr.ready.Load() }
@@ -0,0 +1,782 @@
+package zoneregistry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func newTestZoneRegistry() *ZoneRegistry {
+	zr := newZoneRegistry()
+	zr.Zones = []string{"example.org."}
+	zr.TTL = 300
+	zr.SOA.Serial = 1
+	zr.Services = []string{"app"}
+	zr.Nameservers = []*Nameserver{
+		{Host: "ns.example.org.", IPv4: net.ParseIP("10.0.0.53")},
+	}
+	zr.Next = test.ErrorHandler()
+
+	peer := NewPeer()
+	peer.Host = "peer1.example.org."
+	peer.IPv4 = net.ParseIP("10.0.0.1")
+	peer.Labels = []string{"cluster-env=prod"}
+	peer.Healthy = true
+	zr.Peers = []*Peer{peer}
+	zr.publishHealth()
+	return zr
+}
+
+func TestServeDNS(t *testing.T) {
+	zr := newTestZoneRegistry()
+	ctx := context.TODO()
+
+	tests := []test.Case{
+		{
+			Qname: "example.org.", Qtype: dns.TypeSOA,
+			Answer: []dns.RR{
+				test.SOA("example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 1 7200 1800 86400 30"),
+			},
+			Ns: []dns.RR{
+				test.NS("example.org. 300 IN NS ns.example.org."),
+			},
+			Extra: []dns.RR{
+				test.A("ns.example.org. 300 IN A 10.0.0.53"),
+			},
+		},
+		{
+			Qname: "example.org.", Qtype: dns.TypeNS,
+			Answer: []dns.RR{
+				test.NS("example.org. 300 IN NS ns.example.org."),
+			},
+			Extra: []dns.RR{
+				test.A("ns.example.org. 300 IN A 10.0.0.53"),
+			},
+		},
+		{
+			Qname: "example.org.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.SOA("example.org. 30 IN SOA ns.example.org. hostmaster.example.org. 1 7200 1800 86400 30"),
+			},
+		},
+		// Registry nameserver and peer glue names
+		{
+			Qname: "ns.example.org.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("ns.example.org. 300 IN A 10.0.0.53"),
+			},
+		},
+		{
+			Qname: "peer1.example.org.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("peer1.example.org. 300 IN A 10.0.0.1"),
+			},
+		},
+		{
+			Qname: "peer1.example.org.", Qtype: dns.TypeAAAA,
+			Ns: []dns.RR{
+				test.SOA("example.org. 30 IN SOA ns.example.org. hostmaster.example.org. 1 7200 1800 86400 30"),
+			},
+		},
+		// Query types answered by the registry
+		{
+			Qname: "peer1.example.org.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT(`peer1.example.org. 300 IN TXT "cluster-env=prod"`),
+			},
+		},
+		{
+			Qname: "app.example.org.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT(`app.example.org. 300 IN TXT "peer=peer1.example.org." "cluster-env=prod"`),
+			},
+		},
+		{
+			Qname: "app.example.org.", Qtype: dns.TypeSRV,
+			Answer: []dns.RR{
+				test.SRV("app.example.org. 300 IN SRV 10 1 8080 peer1.example.org."),
+			},
+			Extra: []dns.RR{
+				test.A("peer1.example.org. 300 IN A 10.0.0.1"),
+			},
+		},
+		{
+			Qname: "app.example.org.", Qtype: dns.TypeDS,
+			Ns: []dns.RR{
+				test.SOA("example.org. 30 IN SOA ns.example.org. hostmaster.example.org. 1 7200 1800 86400 30"),
+			},
+		},
+		{
+			Qname: "app.example.org.", Qtype: dns.TypeANY,
+			Answer: []dns.RR{
+				test.HINFO(`app.example.org. 300 IN HINFO "RFC8482" ""`),
+			},
+		},
+		// Unknown name
+		{
+			Qname: "a.b.example.org.", Qtype: dns.TypeA,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.org. 30 IN SOA ns.example.org. hostmaster.example.org. 1 7200 1800 86400 30"),
+			},
+		},
+		{
+			Qname: "a.b.example.org.", Qtype: dns.TypeANY,
+			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.SOA("example.org. 30 IN SOA ns.example.org. hostmaster.example.org. 1 7200 1800 86400 30"),
+			},
+		},
+	}
+
+	for i, tc := range tests {
+		m := tc.Msg()
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := zr.ServeDNS(ctx, rec, m); err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if !rec.Msg.Authoritative {
+			t.Errorf("Test %d: Expected authoritative answer", i)
+		}
+		if err := test.SortAndCheck(rec.Msg, tc); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+	}
+
+	// The default nameserver exists, without any address
+	zr.Nameservers = nil
+	m := new(dns.Msg)
+	m.SetQuestion("ns1.example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	zr.ServeDNS(ctx, rec, m)
+	if rec.Msg.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 0 {
+		t.Errorf("Expected a NODATA answer for the default nameserver, got %s with %v", dns.RcodeToString[rec.Msg.Rcode], rec.Msg.Answer)
+	}
+}
+
+func TestServeDNSServiceRecords(t *testing.T) {
+	zr := newTestZoneRegistry()
+	secondary := NewPeer()
+	secondary.Host = "peer2.example.org."
+	secondary.Role = "secondary"
+	secondary.Weight = 5
+	secondary.Port = 8443
+	secondary.Healthy = true
+
+	tests := []struct {
+		qtype    uint16
+		peer     *Peer
+		expected string
+	}{
+		{dns.TypeSRV, zr.Peers[0], "app.example.org.\t300\tIN\tSRV\t10 1 8080 peer1.example.org."},
+		{dns.TypeSRV, secondary, "app.example.org.\t300\tIN\tSRV\t20 5 8443 peer2.example.org."},
+		{dns.TypeHTTPS, zr.Peers[0], "app.example.org.\t300\tIN\tHTTPS\t10 peer1.example.org. port=\"8080\""},
+		{dns.TypeHTTPS, secondary, "app.example.org.\t300\tIN\tHTTPS\t20 peer2.example.org. port=\"8443\""},
+	}
+
+	for i, tc := range tests {
+		zr.Peers = []*Peer{tc.peer}
+		zr.publishHealth()
+		m := new(dns.Msg)
+		m.SetQuestion("app.example.org.", tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := zr.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].String() != tc.expected {
+			t.Errorf("Test %d: Expected %q, got %v", i, tc.expected, rec.Msg.Answer)
+		}
+	}
+}
+
+func TestServeDNSReferral(t *testing.T) {
+	zr := newTestZoneRegistry()
+	ctx := context.TODO()
+
+	tests := []test.Case{
+		{
+			Qname: "app.example.org.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.NS("app.peer1.example.org. 300 IN NS peer1.example.org."),
+			},
+			Extra: []dns.RR{
+				test.A("peer1.example.org. 300 IN A 10.0.0.1"),
+			},
+		},
+		{
+			Qname: "app.peer1.example.org.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.NS("peer1.example.org. 300 IN NS peer1.example.org."),
+			},
+			Extra: []dns.RR{
+				test.A("peer1.example.org. 300 IN A 10.0.0.1"),
+			},
+		},
+	}
+
+	for i, tc := range tests {
+		m := tc.Msg()
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := zr.ServeDNS(ctx, rec, m); err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if rec.Msg.Authoritative {
+			t.Errorf("Test %d: Expected non-authoritative referral", i)
+		}
+		if err := test.SortAndCheck(rec.Msg, tc); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+	}
+}
+
+func TestPeerLookups(t *testing.T) {
+	zr := newTestZoneRegistry()
+	ctx := context.TODO()
+	peer1 := zr.Peers[0]
+	newPeer := func(host string, healthy bool) *Peer {
+		p := NewPeer()
+		p.Host, p.Zone, p.IPv4 = host, "sub.peer1.example.org.", net.ParseIP("10.0.1.1")
+		p.Healthy, p.Checked = healthy, true
+		return p
+	}
+	ns1, ns2 := newPeer("ns1.sub.peer1.example.org.", true), newPeer("ns2.other.net.", true)
+	zr.setPeers(sourceUpdate, []*Peer{ns1, ns2, newPeer("ns3.other.net.", false)})
+
+	tests := []struct {
+		name            string
+		expectedPeer    *Peer
+		expectedCut     string
+		expectedParents []*Peer
+	}{
+		{"peer1.example.org.", peer1, "peer1.example.org.", []*Peer{peer1}},
+		{"PEER1.example.org.", peer1, "peer1.example.org.", []*Peer{peer1}},
+		{"www.peer1.example.org.", nil, "peer1.example.org.", []*Peer{peer1}},
+		// The unhealthy peers of a subzone are left out
+		{"sub.peer1.example.org.", nil, "sub.peer1.example.org.", []*Peer{ns1, ns2}},
+		{"www.sub.peer1.example.org.", nil, "sub.peer1.example.org.", []*Peer{ns1, ns2}},
+		{"ns1.sub.peer1.example.org.", ns1, "sub.peer1.example.org.", []*Peer{ns1, ns2}},
+		{"app.example.org.", nil, "", nil},
+	}
+	for i, test := range tests {
+		if p := zr.peer(test.name); p != test.expectedPeer {
+			t.Errorf("Test %d: Expected peer %v for %s, got %v", i, test.expectedPeer, test.name, p)
+		}
+		if cut, peers := zr.parentPeers(test.name); cut != test.expectedCut || !slices.Equal(peers, test.expectedParents) {
+			t.Errorf("Test %d: Expected parent peers %v of %s for %s, got %v of %s", i, test.expectedParents, test.expectedCut, test.name, peers, cut)
+		}
+	}
+
+	// A name inside the subzone is referred to all of its healthy peers, while
+	// the DS records of the subzone are answered by the registry
+	cases := []test.Case{
+		{
+			Qname: "www.sub.peer1.example.org.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.NS("sub.peer1.example.org. 300 IN NS ns1.sub.peer1.example.org."),
+				test.NS("sub.peer1.example.org. 300 IN NS ns2.other.net."),
+			},
+			Extra: []dns.RR{
+				test.A("ns1.sub.peer1.example.org. 300 IN A 10.0.1.1"),
+				test.A("ns2.other.net. 300 IN A 10.0.1.1"),
+			},
+		},
+		{
+			Qname: "sub.peer1.example.org.", Qtype: dns.TypeDS,
+			Ns: []dns.RR{
+				test.SOA("example.org. 30 IN SOA ns.example.org. hostmaster.example.org. 1 7200 1800 86400 30"),
+			},
+		},
+	}
+	for i, tc := range cases {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := zr.ServeDNS(ctx, rec, tc.Msg()); err != nil {
+			t.Errorf("Case %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if tc.Qtype == dns.TypeDS && !rec.Msg.Authoritative {
+			t.Errorf("Case %d: Expected an authoritative answer", i)
+		}
+		if err := test.SortAndCheck(rec.Msg, tc); err != nil {
+			t.Errorf("Case %d: %v", i, err)
+		}
+	}
+}
+
+func TestServeDNSFallthrough(t *testing.T) {
+	zr := newTestZoneRegistry()
+	zr.Fall.SetZonesFromArgs(nil)
+	zr.Next = test.NextHandler(dns.RcodeRefused, nil)
+	ctx := context.TODO()
+
+	tests := []struct {
+		qname         string
+		qtype         uint16
+		expectedRcode int
+	}{
+		{qname: "app.example.org.", qtype: dns.TypeA, expectedRcode: dns.RcodeSuccess},
+		{qname: "db.example.org.", qtype: dns.TypeA, expectedRcode: dns.RcodeRefused},
+		{qname: "peer1.example.org.", qtype: dns.TypeMX, expectedRcode: dns.RcodeRefused},
+		{qname: "www.peer1.example.org.", qtype: dns.TypeA, expectedRcode: dns.RcodeSuccess},
+	}
+
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := zr.ServeDNS(ctx, rec, m)
+		if rcode != tc.expectedRcode {
+			t.Errorf("Test %d: Expected rcode %d for %s, got %d", i, tc.expectedRcode, tc.qname, rcode)
+		}
+	}
+
+	// Without services, every name is delegated
+	zr.Services = nil
+	m := new(dns.Msg)
+	m.SetQuestion("db.example.org.", dns.TypeA)
+	if rcode, _ := zr.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), m); rcode != dns.RcodeSuccess {
+		t.Errorf("Expected db.example.org. to be delegated without services, got rcode %d", rcode)
+	}
+}
+
+func TestServeDNSAnswerMode(t *testing.T) {
+	zr := newTestZoneRegistry()
+	zr.Mode = modeAnswer
+	peer := NewPeer()
+	peer.Host = "peer2.example.org."
+	peer.IPv4 = net.ParseIP("10.0.0.2")
+	peer.IPv6 = net.ParseIP("2001:db8::2")
+	peer.Healthy = true
+	zr.Peers = append(zr.Peers, peer)
+	zr.publishHealth()
+	ctx := context.TODO()
+
+	tests := []test.Case{
+		{
+			Qname: "app.example.org.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("app.example.org. 300 IN A 10.0.0.1"),
+				test.A("app.example.org. 300 IN A 10.0.0.2"),
+			},
+		},
+		{
+			Qname: "app.example.org.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{
+				test.AAAA("app.example.org. 300 IN AAAA 2001:db8::2"),
+			},
+		},
+		// Names inside a peer's subzone are still referred to the peer
+		{
+			Qname: "www.peer2.example.org.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.NS("peer2.example.org. 300 IN NS peer2.example.org."),
+			},
+			Extra: []dns.RR{
+				test.A("peer2.example.org. 300 IN A 10.0.0.2"),
+				test.AAAA("peer2.example.org. 300 IN AAAA 2001:db8::2"),
+			},
+		},
+	}
+
+	for i, tc := range tests {
+		m := tc.Msg()
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := zr.ServeDNS(ctx, rec, m); err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if err := test.SortAndCheck(rec.Msg, tc); err != nil {
+			t.Errorf("Test %d: %v", i, err)
+		}
+	}
+}
+
+func TestGetHealthyPeers(t *testing.T) {
+	newPeer := func(host, role string, healthy bool) *Peer {
+		p := NewPeer()
+		p.Host, p.Role, p.Healthy, p.Checked = host, role, healthy, true
+		return p
+	}
+	newUncheckedPeer := func(host, role string) *Peer {
+		p := NewPeer()
+		p.Host, p.Role = host, role
+		return p
+	}
+
+	tests := []struct {
+		peers         []*Peer
+		initialState  string
+		expectedHosts []string
+	}{
+		{
+			peers:         []*Peer{newPeer("p1.", "primary", true), newPeer("s1.", "secondary", true)},
+			expectedHosts: []string{"p1."},
+		},
+		{
+			peers:         []*Peer{newPeer("p1.", "primary", false), newPeer("s1.", "secondary", true)},
+			expectedHosts: []string{"s1."},
+		},
+		{
+			peers:         []*Peer{newPeer("p1.", "primary", false), newPeer("s1.", "secondary", false)},
+			expectedHosts: []string{"p1.", "s1."},
+		},
+		// Peers that weren't checked yet
+		{
+			peers:         []*Peer{newPeer("p1.", "primary", false), newUncheckedPeer("p2.", "primary")},
+			initialState:  initialUnknown,
+			expectedHosts: []string{"p2."},
+		},
+		{
+			peers:         []*Peer{newPeer("s1.", "secondary", true), newUncheckedPeer("p2.", "primary")},
+			initialState:  initialUnknown,
+			expectedHosts: []string{"s1."},
+		},
+		{
+			peers:         []*Peer{newPeer("s1.", "secondary", true), newUncheckedPeer("p2.", "primary")},
+			initialState:  initialHealthy,
+			expectedHosts: []string{"p2."},
+		},
+		{
+			peers:         []*Peer{newPeer("p1.", "primary", false), newUncheckedPeer("p2.", "primary")},
+			initialState:  initialUnhealthy,
+			expectedHosts: []string{"p1."},
+		},
+		// Before any check, only unhealthy keeps the peers out of rotation
+		{
+			peers:         []*Peer{newUncheckedPeer("p1.", "primary"), newUncheckedPeer("s1.", "secondary")},
+			initialState:  initialUnknown,
+			expectedHosts: []string{"p1.", "s1."},
+		},
+		{
+			peers:         []*Peer{newUncheckedPeer("p1.", "primary"), newUncheckedPeer("s1.", "secondary")},
+			initialState:  initialHealthy,
+			expectedHosts: []string{"p1."},
+		},
+		{
+			peers:         []*Peer{newUncheckedPeer("p1.", "primary"), newUncheckedPeer("s1.", "secondary")},
+			initialState:  initialUnhealthy,
+			expectedHosts: []string{},
+		},
+	}
+
+	for i, test := range tests {
+		zr := newZoneRegistry()
+		if test.initialState != "" {
+			zr.InitialState = test.initialState
+		}
+		zr.Peers = test.peers
+		zr.publishHealth()
+
+		peers := zr.GetHealthyPeers()
+		if len(peers) != len(test.expectedHosts) {
+			t.Errorf("Test %d, expected %d healthy peers, got: %d", i, len(test.expectedHosts), len(peers))
+			continue
+		}
+		for j, host := range test.expectedHosts {
+			if peers[j].Host != host {
+				t.Errorf("Test %d, expected peer %s, got: %s", i, host, peers[j].Host)
+			}
+		}
+	}
+}
+
+func TestGetHealthyPeersLoad(t *testing.T) {
+	newPeer := func(host string, reported ...float64) *Peer {
+		p := NewPeer()
+		p.Host, p.Role, p.Healthy, p.Checked = host, "primary", true, true
+		if len(reported) > 0 {
+			p.reported.Store(&reported[0])
+		}
+		return p
+	}
+
+	tests := []struct {
+		peers         []*Peer
+		expectedHosts []string
+	}{
+		// Nothing reported
+		{
+			peers:         []*Peer{newPeer("p1."), newPeer("p2.")},
+			expectedHosts: []string{"p1.", "p2."},
+		},
+		// The least loaded first, peers without a report keeping their weight
+		{
+			peers:         []*Peer{newPeer("p1.", 0.5), newPeer("p2."), newPeer("p3.", 2)},
+			expectedHosts: []string{"p3.", "p2.", "p1."},
+		},
+		// Saturated peers are left out
+		{
+			peers:         []*Peer{newPeer("p1.", 0), newPeer("p2.", 0.25)},
+			expectedHosts: []string{"p2."},
+		},
+		// Unless they all are
+		{
+			peers:         []*Peer{newPeer("p1.", 0), newPeer("p2.", 0)},
+			expectedHosts: []string{"p1.", "p2."},
+		},
+	}
+
+	for i, test := range tests {
+		zr := newZoneRegistry()
+		zr.Peers = test.peers
+		zr.publishHealth()
+
+		var hosts []string
+		for _, p := range zr.GetHealthyPeers() {
+			hosts = append(hosts, p.Host)
+		}
+		if !slices.Equal(hosts, test.expectedHosts) {
+			t.Errorf("Test %d, expected peers %v, got: %v", i, test.expectedHosts, hosts)
+		}
+	}
+}
+
+// newTestHealthServer starts an HTTP server answering health checks with status
+// and returns a peer pointing to it.
+func newTestHealthServer(t *testing.T, status int) (*httptest.Server, *Peer) {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+
+	peer := NewPeer()
+	peer.Host = "peer.example.org."
+	peer.IPv4 = net.ParseIP(u.Hostname())
+	peer.Port = uint32(port)
+	return s, peer
+}
+
+func TestHealthChecksLifecycle(t *testing.T) {
+	s, peer := newTestHealthServer(t, http.StatusOK)
+	defer s.Close()
+
+	zr := newZoneRegistry()
+	zr.Peers = []*Peer{peer}
+	zr.publishHealth()
+
+	if err := zr.OnStartup(); err != nil {
+		t.Fatalf("Expected no error on startup, got %v", err)
+	}
+
+	// The first probe must not wait for the interval
+	deadline := time.Now().Add(2 * time.Second)
+	for !zr.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the registry to be ready right after startup")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(zr.health.Load().primary) != 1 {
+		t.Errorf("Expected the peer to be healthy after the first health check cycle")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		zr.OnShutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the health checks to stop on shutdown")
+	}
+}
+
+// concurrencyCheck records the highest number of probes running at once.
+type concurrencyCheck struct {
+	running atomic.Int32
+	max     atomic.Int32
+	calls   atomic.Int32
+}
+
+func (c *concurrencyCheck) Check(ctx context.Context, p *Peer, ip net.IP) error {
+	c.calls.Add(1)
+	n := c.running.Add(1)
+	defer c.running.Add(-1)
+	for {
+		m := c.max.Load()
+		if n <= m || c.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+func TestCheckPeersConcurrency(t *testing.T) {
+	check := &concurrencyCheck{}
+
+	zr := newZoneRegistry()
+	zr.MaxConcurrentChecks = 3
+	zr.Jitter = 20 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		peer := NewPeer()
+		peer.Host = fmt.Sprintf("peer%d.example.org.", i)
+		peer.IPv4 = net.ParseIP("127.0.0.1")
+		peer.Check = check
+		zr.Peers = append(zr.Peers, peer)
+	}
+
+	zr.checkPeers(context.TODO())
+
+	if n := check.calls.Load(); n != 10 {
+		t.Errorf("Expected 10 peers to be probed, got %d", n)
+	}
+	if n := check.max.Load(); n > 3 {
+		t.Errorf("Expected at most 3 concurrent probes, got %d", n)
+	}
+	if len(zr.health.Load().primary) != 10 {
+		t.Errorf("Expected 10 healthy peers, got %d", len(zr.health.Load().primary))
+	}
+}
+
+func TestServeDNSGlue(t *testing.T) {
+	tests := []struct {
+		glue          []string
+		families      map[string]bool
+		expectedExtra []dns.RR
+	}{
+		{
+			glue: allFamilies,
+			expectedExtra: []dns.RR{
+				test.A("peer1.example.org. 300 IN A 10.0.0.1"),
+				test.AAAA("peer1.example.org. 300 IN AAAA 2001:db8::1"),
+			},
+		},
+		{
+			glue:     allFamilies,
+			families: map[string]bool{familyIPv4: false, familyIPv6: true},
+			expectedExtra: []dns.RR{
+				test.AAAA("peer1.example.org. 300 IN AAAA 2001:db8::1"),
+			},
+		},
+		// Both families failing keep their glue, the peer being used as a last resort
+		{
+			glue:     allFamilies,
+			families: map[string]bool{familyIPv4: false, familyIPv6: false},
+			expectedExtra: []dns.RR{
+				test.A("peer1.example.org. 300 IN A 10.0.0.1"),
+				test.AAAA("peer1.example.org. 300 IN AAAA 2001:db8::1"),
+			},
+		},
+		{
+			glue: []string{familyIPv4},
+			expectedExtra: []dns.RR{
+				test.A("peer1.example.org. 300 IN A 10.0.0.1"),
+			},
+		},
+		{
+			glue: []string{familyIPv6, familyIPv4},
+			expectedExtra: []dns.RR{
+				test.AAAA("peer1.example.org. 300 IN AAAA 2001:db8::1"),
+				test.A("peer1.example.org. 300 IN A 10.0.0.1"),
+			},
+		},
+	}
+
+	for i, tc := range tests {
+		zr := newTestZoneRegistry()
+		zr.Glue = tc.glue
+		zr.Peers[0].IPv6 = net.ParseIP("2001:db8::1")
+		zr.Peers[0].state.families = tc.families
+		zr.publishHealth()
+
+		m := new(dns.Msg)
+		m.SetQuestion("app.example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := zr.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+
+		// The glue order matters, don't sort the section
+		if len(rec.Msg.Extra) != len(tc.expectedExtra) {
+			t.Errorf("Test %d: Expected %d glue records, got %v", i, len(tc.expectedExtra), rec.Msg.Extra)
+			continue
+		}
+		for j, rr := range tc.expectedExtra {
+			if rec.Msg.Extra[j].String() != rr.String() {
+				t.Errorf("Test %d: Expected glue %s, got %s", i, rr, rec.Msg.Extra[j])
+			}
+		}
+	}
+}
+
+func TestServeDNSResolvedAddrs(t *testing.T) {
+	zr := newTestZoneRegistry()
+	peer := zr.Peers[0]
+	peer.IPv4 = nil
+	peer.resolved.Store(&resolvedAddrs{
+		IPv4: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+		IPv6: []net.IP{net.ParseIP("2001:db8::1")},
+	})
+
+	tests := []struct {
+		addrs         map[string]bool
+		expectedExtra []dns.RR
+	}{
+		{
+			expectedExtra: []dns.RR{
+				test.A("peer1.example.org. 300 IN A 10.0.0.1"),
+				test.A("peer1.example.org. 300 IN A 10.0.0.2"),
+				test.AAAA("peer1.example.org. 300 IN AAAA 2001:db8::1"),
+			},
+		},
+		// A failed address is left out while another one of its family is healthy
+		{
+			addrs: map[string]bool{"10.0.0.1": false, "10.0.0.2": true, "2001:db8::1": true},
+			expectedExtra: []dns.RR{
+				test.A("peer1.example.org. 300 IN A 10.0.0.2"),
+				test.AAAA("peer1.example.org. 300 IN AAAA 2001:db8::1"),
+			},
+		},
+		{
+			addrs: map[string]bool{"10.0.0.1": false, "10.0.0.2": false, "2001:db8::1": true},
+			expectedExtra: []dns.RR{
+				test.AAAA("peer1.example.org. 300 IN AAAA 2001:db8::1"),
+			},
+		},
+	}
+
+	for i, tc := range tests {
+		peer.state.addrs = tc.addrs
+		peer.state.families = addressFamilies(tc.addrs)
+		zr.publishHealth()
+
+		m := new(dns.Msg)
+		m.SetQuestion("app.example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := zr.ServeDNS(context.TODO(), rec, m); err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if len(rec.Msg.Extra) != len(tc.expectedExtra) {
+			t.Errorf("Test %d: Expected %d glue records, got %v", i, len(tc.expectedExtra), rec.Msg.Extra)
+			continue
+		}
+		for j, rr := range tc.expectedExtra {
+			if rec.Msg.Extra[j].String() != rr.String() {
+				t.Errorf("Test %d: Expected glue %s, got %s", i, rr, rec.Msg.Extra[j])
+			}
+		}
+	}
+}